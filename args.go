@@ -0,0 +1,132 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// normalizeGoStyleLongFlags rewrites long flags into the form pflag expects.
+// Single-dash long flags in the style of Go's flag package, such as -verbose
+// or -buffersize=4, get a second dash, and an unambiguous prefix of a long
+// flag name, such as -buf or --buf, is expanded to the full name. A prefix
+// matching several flags is an error. Bundled shorthands such as -vb are
+// left for pflag, as are values given as a separate argument, such as the
+// file name after --exclude-from, and anything after a "--" terminator.
+func normalizeGoStyleLongFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	normalized := make([]string, 0, len(args))
+	takesValue := false
+	for i, arg := range args {
+		if takesValue {
+			normalized = append(normalized, arg)
+			takesValue = false
+			continue
+		}
+		if arg == "--" {
+			return append(normalized, args[i:]...), nil
+		}
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			f, err := lookupLongFlag(fs, arg, name)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil && f.Name != name {
+				arg = joinFlag(f.Name, value, hasValue)
+			}
+			takesValue = !hasValue && needsValue(f)
+		case len(arg) > 1 && arg[0] == '-':
+			name, value, hasValue := strings.Cut(arg[1:], "=")
+			if f := fs.Lookup(name); len(name) > 1 && f != nil {
+				arg = "-" + arg
+				takesValue = !hasValue && needsValue(f)
+				break
+			}
+			if len(name) < 2 || shorthandSwitches(fs, arg[1:]) {
+				takesValue = shorthandsNeedValue(fs, arg[1:])
+				break
+			}
+			f, err := lookupLongFlag(fs, arg, name)
+			if err != nil {
+				return nil, err
+			}
+			if f == nil {
+				takesValue = shorthandsNeedValue(fs, arg[1:])
+				break
+			}
+			arg = joinFlag(f.Name, value, hasValue)
+			takesValue = !hasValue && needsValue(f)
+		}
+		normalized = append(normalized, arg)
+	}
+	return normalized, nil
+}
+
+// lookupLongFlag returns the flag named name, or the only visible flag whose
+// name starts with it. It returns nil if nothing matches, and an error naming
+// the candidates if the prefix is ambiguous.
+func lookupLongFlag(fs *flag.FlagSet, arg, name string) (*flag.Flag, error) {
+	if f := fs.Lookup(name); f != nil || len(name) < 2 {
+		return f, nil
+	}
+	var matches []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if !f.Hidden && strings.HasPrefix(f.Name, name) {
+			matches = append(matches, f.Name)
+		}
+	})
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return fs.Lookup(matches[0]), nil
+	}
+	sort.Strings(matches)
+	return nil, fmt.Errorf("ambiguous flag %s: could be --%s", arg, strings.Join(matches, ", --"))
+}
+
+func joinFlag(name, value string, hasValue bool) string {
+	if hasValue {
+		return "--" + name + "=" + value
+	}
+	return "--" + name
+}
+
+// needsValue reports whether f, given without "=value", consumes the next
+// argument as its value.
+func needsValue(f *flag.Flag) bool {
+	return f != nil && f.NoOptDefVal == ""
+}
+
+// shorthandSwitches reports whether every character of bundle is a
+// shorthand that takes no value, as in -vv. Such bundles are never treated
+// as a long flag prefix.
+func shorthandSwitches(fs *flag.FlagSet, bundle string) bool {
+	for i := 0; i < len(bundle); i++ {
+		if f := fs.ShorthandLookup(bundle[i : i+1]); f == nil || needsValue(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// shorthandsNeedValue reports whether the bundled shorthands in bundle end
+// with a flag that consumes the next argument, as "b" does in "-vb 4".
+func shorthandsNeedValue(fs *flag.FlagSet, bundle string) bool {
+	for i := 0; i < len(bundle); i++ {
+		f := fs.ShorthandLookup(bundle[i : i+1])
+		if f == nil {
+			return false
+		}
+		if needsValue(f) {
+			// The rest of the bundle, if any, is the value.
+			return i == len(bundle)-1
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// autotuneCandidatesMB are the buffer sizes tried by --autotune.
+var autotuneCandidatesMB = []int{1, 2, 4, 8, 16}
+
+// autotuneSampleBytes is the size of the scratch file rewritten once per
+// candidate buffer size.
+var autotuneSampleBytes int64 = 16 * bytesPerMB
+
+// autotuneBufferSize rewrites a scratch file in dir once with each candidate
+// buffer size and returns the size, in bytes, that finished fastest. The
+// scratch file is always removed before returning.
+func autotuneBufferSize(dir string, candidatesMB []int) (int, error) {
+	f, err := os.CreateTemp(dir, "."+appName+"-autotune-*")
+	if err != nil {
+		return 0, fmt.Errorf("create benchmark file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	fill := make([]byte, bytesPerMB)
+	for i := range fill {
+		fill[i] = byte(i)
+	}
+	for written := int64(0); written < autotuneSampleBytes; {
+		chunk := fill
+		if remaining := autotuneSampleBytes - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := f.WriteAt(chunk, written)
+		if err != nil {
+			return 0, fmt.Errorf("write benchmark file: %w", err)
+		}
+		written += int64(n)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("flush benchmark file: %w", err)
+	}
+
+	best := 0
+	var bestElapsed time.Duration
+	for _, sizeMB := range candidatesMB {
+		bufferSizeBytes, err := bufferSizeBytesFromMB(sizeMB)
+		if err != nil {
+			return 0, err
+		}
+		elapsed, err := timeRewrite(f, bufferSizeBytes)
+		if err != nil {
+			return 0, err
+		}
+		logVerbose(verbosityChunks, "Autotune: %d MB buffer rewrote %d bytes in %s.", sizeMB, autotuneSampleBytes, elapsed)
+		if best == 0 || elapsed < bestElapsed {
+			best = bufferSizeBytes
+			bestElapsed = elapsed
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("no candidate buffer sizes")
+	}
+	return best, nil
+}
+
+// timeRewrite rewrites f in place with the given buffer size, flushes it, and
+// returns how long that took.
+func timeRewrite(f *os.File, bufferSizeBytes int) (time.Duration, error) {
+	buf := make([]byte, bufferSizeBytes)
+	start := time.Now()
+	for offset := int64(0); offset < autotuneSampleBytes; {
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 && err != nil {
+			return 0, fmt.Errorf("read benchmark file: %w", err)
+		}
+		if _, err := f.WriteAt(buf[:n], offset); err != nil {
+			return 0, fmt.Errorf("write benchmark file: %w", err)
+		}
+		offset += int64(n)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("flush benchmark file: %w", err)
+	}
+	return time.Since(start), nil
+}
@@ -1,11 +1,72 @@
 package main
 
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
 const (
 	appName    = "filerewrite"
 	bytesPerMB = 1024 * 1024
+
+	// maxZeroWriteRetries bounds how many consecutive zero-byte writes are
+	// tolerated at one offset before a rewrite is failed.
+	maxZeroWriteRetries = 3
+
+	// exitDeadlineReached is the exit status when --deadline or --until
+	// stopped the run before every path was started.
+	exitDeadlineReached = 3
+
+	// exitNothingRewritten is the exit status when the run succeeded but every
+	// path was skipped, so nothing was rewritten or touched.
+	exitNothingRewritten = 4
+
+	// exitManifestMismatch is the exit status when nothing failed but some
+	// files did not match --compare-manifest.
+	exitManifestMismatch = 5
+
+	// bufferSizeEnv supplies the default for -b when the flag is not given.
+	bufferSizeEnv = "FILEREWRITE_BUFFERSIZE"
+
+	// contentMarkerAttr is the extended attribute holding the SHA-256 of a
+	// file's content as of its last rewrite, used by --skip-if-clean.
+	contentMarkerAttr = "user.filerewrite.sha256"
+
+	// contentMarkerVersion prefixes every stored content marker. Bump it when
+	// a change means markers written by earlier builds can no longer be
+	// trusted, so those files are rewritten once more.
+	contentMarkerVersion = "1"
 )
 
 // appVersion is set at build time via ldflags:
 //
 //	go build -ldflags "-X main.appVersion=v1.2.3"
 var appVersion = "dev"
+
+var readBuildInfo = debug.ReadBuildInfo
+
+// versionText describes this build for --version. The first line is the bare
+// version so scripts reading only that line keep working.
+func versionText() string {
+	commit := "unknown"
+	if info, ok := readBuildInfo(); ok {
+		var revision string
+		var modified bool
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if revision != "" {
+			commit = revision
+			if modified {
+				commit += "-dirty"
+			}
+		}
+	}
+	return fmt.Sprintf("%s\ncommit: %s\ngo: %s", appVersion, commit, runtime.Version())
+}
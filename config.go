@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	flag "github.com/spf13/pflag"
+)
+
+const configFileName = "config.json"
+
+// configExcludedFlags are flags that select a one-shot action, name files
+// that belong to a single run, or are dangerous or only meant for testing,
+// rather than a default option, so they cannot be set from a config file.
+var configExcludedFlags = map[string]bool{
+	"allow-devices":       true,
+	"compare-manifest":    true,
+	"config":              true,
+	"help":                true,
+	"io-delay":            true,
+	"manifest":            true,
+	"plan":                true,
+	"retry-failed":        true,
+	"selfupdate":          true,
+	"simulate-error-rate": true,
+	"version":             true,
+}
+
+var userConfigDir = os.UserConfigDir
+
+func defaultConfigPath() string {
+	dir, err := userConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, appName, configFileName)
+}
+
+// loadConfig reads a JSON object mapping long flag names to default values.
+// A missing file is only an error when the path was requested explicitly.
+func loadConfig(path string, explicit bool) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]any
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// applyConfig sets each configured flag that was not given on the command
+// line, so command-line flags always take precedence over the config file.
+func applyConfig(flags *flag.FlagSet, values map[string]any, given map[string]bool) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if flags.Lookup(name) == nil || configExcludedFlags[name] {
+			return fmt.Errorf("unknown config option %q", name)
+		}
+		if given[name] {
+			continue
+		}
+
+		var text string
+		switch value := values[name].(type) {
+		case bool:
+			text = strconv.FormatBool(value)
+		case json.Number:
+			text = value.String()
+		case string:
+			text = value
+		default:
+			return fmt.Errorf("invalid value for config option %q: must be a string, number, or boolean", name)
+		}
+		if err := flags.Set(name, text); err != nil {
+			return fmt.Errorf("invalid value for config option %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func givenFlags(flags *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
@@ -0,0 +1,136 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestCLIConfigSetsDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	configPath := writeConfig(t, `{"dry-run": true, "stats": true, "buffersize": 2}`)
+
+	exitCode, _, stderr := runCLI(t, "--config", configPath, path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "WOULD REWRITE "+path) {
+		t.Fatalf("config dry-run not applied: %q", stderr)
+	}
+	if !strings.Contains(stderr, "Summary: paths=1 ") {
+		t.Fatalf("config stats not applied: %q", stderr)
+	}
+}
+
+func TestCLIConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	configPath := writeConfig(t, `{"buffersize": 0, "dry-run": true}`)
+
+	exitCode, _, stderr := runCLI(t, "--config", configPath, path)
+	if exitCode != 2 || !strings.Contains(stderr, "invalid buffer size 0 MB") {
+		t.Fatalf("config buffer size not applied; exit code = %d, stderr=%q", exitCode, stderr)
+	}
+
+	t.Setenv(bufferSizeEnv, "1")
+	exitCode, _, stderr = runCLI(t, "--config", configPath, path)
+	if exitCode != 0 {
+		t.Fatalf("environment should override config; exit code = %d, stderr=%q", exitCode, stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--config", configPath, "--dry-run=false", "-b", "1", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if strings.Contains(stderr, "WOULD REWRITE") {
+		t.Fatalf("command-line flag should override config: %q", stderr)
+	}
+}
+
+func TestCLIConfigRejectsUnknownOption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	for _, content := range []string{`{"bogus": true}`, `{"selfupdate": true}`, `{"plan": "plan.json"}`, `{"retry-failed": "errors.log"}`, `{"manifest": "sums"}`, `{"compare-manifest": "sums"}`, `{"allow-devices": true}`, `{"simulate-error-rate": 1}`, `{"io-delay": "1s"}`} {
+		configPath := writeConfig(t, content)
+		exitCode, _, stderr := runCLI(t, "--config", configPath, path)
+		if exitCode != 2 {
+			t.Fatalf("%s: exit code = %d, want 2; stderr=%q", content, exitCode, stderr)
+		}
+		if !strings.Contains(stderr, "unknown config option") {
+			t.Fatalf("%s: expected unknown option error, got: %q", content, stderr)
+		}
+	}
+}
+
+func TestConfigExcludesHiddenTestingFlags(t *testing.T) {
+	fs, _ := newFlagSet(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Hidden && !configExcludedFlags[f.Name] {
+			t.Fatalf("hidden flag --%s can be set from a config file", f.Name)
+		}
+	})
+}
+
+func TestCLIConfigMissingExplicitFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.json")
+
+	exitCode, _, stderr := runCLI(t, "--config", missing, path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "read config "+missing) {
+		t.Fatalf("expected missing config error, got: %q", stderr)
+	}
+}
+
+func TestLoadConfigIgnoresMissingDefaultFile(t *testing.T) {
+	values, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"), false)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if values != nil {
+		t.Fatalf("values = %v, want nil", values)
+	}
+}
+
+func TestDefaultConfigPathUsesUserConfigDir(t *testing.T) {
+	original := userConfigDir
+	userConfigDir = func() (string, error) {
+		return "/home/user/.config", nil
+	}
+	t.Cleanup(func() {
+		userConfigDir = original
+	})
+
+	if got, want := defaultConfigPath(), "/home/user/.config/filerewrite/config.json"; got != want {
+		t.Fatalf("defaultConfigPath() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const blkGetSize64 = 0x80081272
+
+// charDevicesRewritable is false because Linux disks are block devices, and
+// its character devices, such as terminals and /dev/null, have no size to
+// rewrite up to.
+const charDevicesRewritable = false
+
+// deviceSize returns the size in bytes of the block device open on fd.
+func deviceSize(fd int, sb *syscall.Stat_t) (int64, error) {
+	if sb.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return 0, syscall.ENOTSUP
+	}
+
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), blkGetSize64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
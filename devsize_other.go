@@ -0,0 +1,25 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"io"
+	"syscall"
+)
+
+// charDevicesRewritable is true because these systems expose disks as
+// character devices, such as /dev/rdisk0 on macOS or /dev/ada0 on FreeBSD.
+const charDevicesRewritable = true
+
+// deviceSize returns the size in bytes of the device open on fd by seeking to
+// its end, which these kernels support for disk devices.
+func deviceSize(fd int, sb *syscall.Stat_t) (int64, error) {
+	size, err := syscall.Seek(fd, 0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if size <= 0 {
+		return 0, syscall.ENOTSUP
+	}
+	return size, nil
+}
@@ -0,0 +1,25 @@
+//go:build (linux || freebsd) && (amd64 || arm64)
+
+package main
+
+import "syscall"
+
+// posixFadvDontNeed is POSIX_FADV_DONTNEED, which has the same value on
+// Linux and FreeBSD.
+const posixFadvDontNeed = 4
+
+// fadviseDontNeed asks the kernel to drop the cached pages of fd in
+// [offset, offset+length), so the next read of the range goes to the device.
+// A length of 0 means to the end of the file. Dirty pages are not dropped, so
+// the range must be flushed first.
+func fadviseDontNeed(fd int, offset, length int64) error {
+	r1, _, errno := syscall.Syscall6(sysFadvise, uintptr(fd), uintptr(offset), uintptr(length), posixFadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	// FreeBSD returns the error number as the result instead of in errno.
+	if r1 != 0 {
+		return syscall.Errno(r1)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build freebsd && (amd64 || arm64)
+
+package main
+
+import "syscall"
+
+const sysFadvise = syscall.SYS_POSIX_FADVISE
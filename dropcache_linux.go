@@ -0,0 +1,7 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import "syscall"
+
+const sysFadvise = syscall.SYS_FADVISE64
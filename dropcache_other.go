@@ -0,0 +1,11 @@
+//go:build darwin || netbsd || openbsd || ((linux || freebsd) && !amd64 && !arm64)
+
+package main
+
+import "syscall"
+
+// fadviseDontNeed is not available here, so reads after a write may be
+// served from the page cache.
+func fadviseDontNeed(fd int, offset, length int64) error {
+	return syscall.ENOTSUP
+}
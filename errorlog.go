@@ -0,0 +1,79 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// failureLog appends one "path<TAB>error" line per failed file for
+// --error-log. A backslash, tab or newline in either field is written as
+// \\, \t or \n, so every line has exactly one tab. Each line is written with
+// a single append and flushed, so the lines written before a crash survive it.
+type failureLog struct {
+	path string
+	f    *os.File
+}
+
+var (
+	failureLogEscaper   = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n")
+	failureLogUnescaper = strings.NewReplacer("\\\\", "\\", "\\t", "\t", "\\n", "\n")
+)
+
+// readFailureLog returns the paths recorded in an --error-log file, in order
+// and without repeats, for --retry-failed. The path is everything before the
+// tab on each line, unescaped.
+func readFailureLog(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read error log %s: %w", path, err)
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab <= 0 {
+			return nil, fmt.Errorf("error log %s line %d: want <path><TAB><error>", path, i+1)
+		}
+		if failed := failureLogUnescaper.Replace(line[:tab]); !seen[failed] {
+			seen[failed] = true
+			paths = append(paths, failed)
+		}
+	}
+	return paths, nil
+}
+
+func openFailureLog(path string) (*failureLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open error log %s: %w", path, err)
+	}
+	return &failureLog{path: path, f: f}, nil
+}
+
+func (l *failureLog) add(path string, err error) {
+	if l == nil {
+		return
+	}
+	if _, werr := fmt.Fprintf(l.f, "%s\t%s\n", failureLogEscaper.Replace(path), failureLogEscaper.Replace(fmt.Sprint(err))); werr != nil {
+		logWarningWithError(werr, "Unable to write to error log %s", l.path)
+		return
+	}
+	if serr := l.f.Sync(); serr != nil {
+		logWarningWithError(serr, "Unable to flush error log %s", l.path)
+	}
+}
+
+func (l *failureLog) close() {
+	if l == nil {
+		return
+	}
+	if err := l.f.Close(); err != nil {
+		logWarningWithError(err, "Unable to close error log %s", l.path)
+	}
+}
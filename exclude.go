@@ -0,0 +1,56 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadExcludePatterns reads one glob pattern per line from path. Blank lines
+// and lines starting with # are ignored.
+func loadExcludePatterns(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read exclude patterns %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q at %s:%d: %w", pattern, path, line, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read exclude patterns %s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// excludedBy reports whether path matches any of patterns. As with rsync, a
+// pattern containing a slash is matched against the whole path and any other
+// pattern against the final path component.
+func excludedBy(patterns []string, path string) bool {
+	clean := filepath.Clean(path)
+	base := filepath.Base(clean)
+	for _, pattern := range patterns {
+		target := base
+		if strings.Contains(pattern, "/") {
+			target = clean
+		}
+		if matched, _ := filepath.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
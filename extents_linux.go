@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fsIocFiemap      = 0xC020660B
+	fiemapFlagSync   = 0x1
+	fiemapExtentLast = 0x1
+	fiemapBatch      = 128
+)
+
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+type fiemapRequest struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extents       [fiemapBatch]fiemapExtent
+}
+
+// fileExtents returns the physical extent map of fd using the FIEMAP ioctl.
+func fileExtents(fd int) ([]fileExtent, error) {
+	var extents []fileExtent
+	var start uint64
+	for {
+		req := fiemapRequest{
+			start:       start,
+			length:      ^uint64(0) - start,
+			flags:       fiemapFlagSync,
+			extentCount: fiemapBatch,
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fsIocFiemap, uintptr(unsafe.Pointer(&req))); errno != 0 {
+			return nil, errno
+		}
+		if req.mappedExtents == 0 {
+			return extents, nil
+		}
+
+		for _, e := range req.extents[:req.mappedExtents] {
+			extents = append(extents, fileExtent{logical: e.logical, physical: e.physical, length: e.length})
+			if e.flags&fiemapExtentLast != 0 {
+				return extents, nil
+			}
+		}
+
+		last := req.extents[req.mappedExtents-1]
+		start = last.logical + last.length
+	}
+}
@@ -0,0 +1,9 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+func fileExtents(fd int) ([]fileExtent, error) {
+	return nil, syscall.ENOTSUP
+}
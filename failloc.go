@@ -0,0 +1,70 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// failureLocation identifies where on disk a failure happened, so that I/O
+// errors can be matched against SMART data and the drives of an array.
+type failureLocation struct {
+	dev uint64
+	ino uint64
+	// offset is the file offset of the failed read or write, and physical
+	// its byte offset on the device; each is -1 when not known.
+	offset   int64
+	physical int64
+}
+
+func (l failureLocation) String() string {
+	s := fmt.Sprintf("dev=%d ino=%d", l.dev, l.ino)
+	if l.offset >= 0 {
+		s += fmt.Sprintf(" offset=%d", l.offset)
+	}
+	if l.physical >= 0 {
+		s += fmt.Sprintf(" physical_offset=%d", l.physical)
+	}
+	return s
+}
+
+// withFailureLocation attaches the device, inode and, when the failure
+// happened at a known offset, the file and physical offsets to a failed
+// result and logs them. The physical offset comes from the extent map and is
+// only available on Linux. fd may be -1 when the file could not be opened.
+func withFailureLocation(result pathResult, fd int, sb *syscall.Stat_t) pathResult {
+	location := failureLocation{dev: uint64(sb.Dev), ino: uint64(sb.Ino), offset: -1, physical: -1}
+	if fd >= 0 {
+		var current syscall.Stat_t
+		if err := fstatFile(fd, &current); err == nil {
+			location.dev, location.ino = uint64(current.Dev), uint64(current.Ino)
+		}
+	}
+	var rerr *rewriteError
+	if errors.As(result.err, &rerr) && rerr.hasOffset {
+		location.offset = rerr.offset
+		if fd >= 0 {
+			location.physical = physicalOffset(fd, rerr.offset)
+		}
+	}
+	result.location = &location
+	logWarning("%s failed at %s", result.path, location)
+	return result
+}
+
+// physicalOffset maps a file offset to a byte offset on the device, or
+// returns -1 if the extent map is unavailable or has no extent there.
+func physicalOffset(fd int, offset int64) int64 {
+	extents, err := mapFileExtents(fd)
+	if err != nil {
+		return -1
+	}
+	for _, e := range extents {
+		if uint64(offset) >= e.logical && uint64(offset) < e.logical+e.length {
+			return int64(e.physical + uint64(offset) - e.logical)
+		}
+	}
+	return -1
+}
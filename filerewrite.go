@@ -3,23 +3,72 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	flag "github.com/spf13/pflag"
 )
 
-var verbose bool
+// Verbosity levels selected by repeating -v.
+const (
+	verbosityFiles    = 1
+	verbosityChunks   = 2
+	verbositySyscalls = 3
+)
+
+var verbosity int
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+
+	onErrorContinue = "continue"
+	onErrorSkip     = "skip"
+	onErrorAbort    = "abort"
+
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+var colorEnabled bool
+
+var outputMu sync.Mutex
+
+// drawnBar is the terminal a --progress-bar was last drawn on in place, and
+// nil once that line has been cleared. It is guarded by outputMu.
+var drawnBar io.Writer
+
+// filesystemTypes caches the filesystem type name per device for -vv and
+// --skip-fstype.
+var filesystemTypes = map[uint64]string{}
 
 var (
 	openFile = func(path string, mode int, perm uint32) (int, error) {
-		return syscall.Open(path, mode, perm)
+		return syscall.Open(originalPath(path), mode, perm)
 	}
 	lstatFile = func(path string, sb *syscall.Stat_t) error {
-		return syscall.Lstat(path, sb)
+		return syscall.Lstat(originalPath(path), sb)
+	}
+	statFile = func(path string, sb *syscall.Stat_t) error {
+		return syscall.Stat(originalPath(path), sb)
 	}
 	closeFile = func(fd int) error {
 		return syscall.Close(fd)
@@ -36,8 +85,35 @@ var (
 	syncFile = func(fd int) error {
 		return syscall.Fsync(fd)
 	}
+	mapFileExtents = func(fd int) ([]fileExtent, error) {
+		return fileExtents(fd)
+	}
+	findFileLock = func(sb *syscall.Stat_t) (string, bool, error) {
+		return fileLockHolder(uint64(sb.Dev), uint64(sb.Ino))
+	}
+	findHole = func(fd int) (int64, error) {
+		return firstHole(fd)
+	}
+	noAtimeMount = func(fd int) bool {
+		return atimeDisabled(fd)
+	}
+	readContentMarker = func(fd int) (string, error) {
+		return contentMarker(fd)
+	}
+	writeContentMarker = func(fd int, value string) error {
+		return setContentMarker(fd, value)
+	}
+	statfsType = func(fd int) (string, error) {
+		return filesystemType(fd)
+	}
+	dropCachedPages = func(fd int, offset, length int64) error {
+		return fadviseDontNeed(fd, offset, length)
+	}
 	infoOutput  io.Writer = os.Stderr
 	errorOutput io.Writer = os.Stderr
+	// resultOutput receives machine-consumable results only, so stdout can
+	// be piped to another program while diagnostics stay on stderr.
+	resultOutput io.Writer = os.Stdout
 )
 
 type pathOutcome int
@@ -45,23 +121,145 @@ type pathOutcome int
 const (
 	pathOutcomeFailed pathOutcome = iota
 	pathOutcomeRejectedNonRegular
+	pathOutcomeSkippedNonRegular
 	pathOutcomeSkippedHardlink
 	pathOutcomeSkippedSparse
+	pathOutcomeSkippedFiltered
+	pathOutcomeSkippedReadOnly
+	pathOutcomeSkippedClean
+	pathOutcomeSkippedLocked
 	pathOutcomeWouldRewrite
 	pathOutcomeRewritten
+	pathOutcomeRewrittenTimesNotRestored
+	pathOutcomeTouched
+)
+
+// Sentinel errors identifying which step of processing a path failed. A
+// pathResult error matches exactly one of these with errors.Is and unwraps to
+// the underlying syscall error, if any.
+var (
+	errStat            = errors.New("stat failed")
+	errNotRegular      = errors.New("not a regular file")
+	errIdentityChanged = errors.New("file changed identity between stat and open")
+	errOpen            = errors.New("open failed")
+	errBufferSize      = errors.New("invalid buffer size")
+	errRead            = errors.New("read failed")
+	errWrite           = errors.New("write failed")
+	errSync            = errors.New("flush failed")
+	errTimestamp       = errors.New("timestamp restore failed")
+	errClose           = errors.New("close failed")
+	errDeviceSize      = errors.New("unable to determine device size")
+	errVerify          = errors.New("verification failed")
+	errSimulated       = errors.New("simulated failure")
 )
 
+type rewriteError struct {
+	kind error
+	err  error
+	// offset is the file offset of the failed read or write, if any.
+	offset    int64
+	hasOffset bool
+}
+
+func (e *rewriteError) Error() string {
+	if e.err == nil {
+		return e.kind.Error()
+	}
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+func (e *rewriteError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *rewriteError) Unwrap() error {
+	return e.err
+}
+
+// defaultOpenFlags are the flags files are opened with for rewriting unless
+// processOptions.openFlags replaces them.
+const defaultOpenFlags = syscall.O_RDWR | syscall.O_NOFOLLOW
+
 type processOptions struct {
 	bufferSizeBytes int
 	dryRun          bool
 	dedupHardlinks  bool
 	skipSparse      bool
+	warnOnHoles     bool
+	respectLocks    bool
+	followSymlinks  bool
+	followFinal     bool
+	verifyRelocate  bool
+	allowDevices    bool
+	paranoid        bool
+	skipReadOnly    bool
+	strictTimes     bool
+	followGrowth    bool
+	noAtimeOpen     bool
+	touchOnly       bool
+	skipIfClean     bool
+	reverse         bool
+	// setAtime and setMtime replace the original access and modification
+	// times when the file's timestamps are written back. The zero value keeps
+	// the original.
+	setAtime time.Time
+	setMtime time.Time
+	// openFlags, if nonzero, replaces defaultOpenFlags when a file is opened
+	// for rewriting. The caller is responsible for the result being safe:
+	// dropping O_NOFOLLOW rewrites symlink targets, and flags such as
+	// O_DIRECT impose alignment rules on the buffer size. It must include
+	// O_RDWR. O_NONBLOCK is always added, and O_NOATIME is still controlled
+	// by noAtimeOpen so that it can be retried without.
+	openFlags int
+	// simulateErrors is the probability, from 0 to 1, that a path fails with
+	// errSimulated before it is touched. It exists for testing callers.
+	simulateErrors float64
+	// skipNonRegular reports files that are not rewritable because of their
+	// type as skipped rather than failed, for --on-error=skip.
+	skipNonRegular bool
+	// ioDelay is slept before each buffer is read, simulating a slow device.
+	// It exists for testing callers.
+	ioDelay time.Duration
+	// hashContent computes the SHA-256 of the data in the rewrite loop and
+	// returns it in pathResult.sha256. It needs a forward pass over every
+	// block, so it cannot be combined with reverse or stride.
+	hashContent bool
+	// readHash receives every block read by rewriteBlocks. It is set per file
+	// from hashContent.
+	readHash hash.Hash
+	// knownHashes holds the hashes read for --compare-manifest, by path.
+	// Files are checked against it before they are rewritten.
+	knownHashes map[string]string
+	// stride, if above 1, rewrites only one block in every stride; see
+	// rewriteBlocks.
+	stride int
+	// chunkSizeBytes, if positive, splits each buffer read into writes of at
+	// most this many bytes, each followed by a progress update.
+	chunkSizeBytes int
+	progress       *batchProgress
+	// progressFunc, if set, is called after every successful write with the
+	// number of bytes rewritten so far and the file size from fstat.
+	progressFunc func(path string, done, total int64)
+	// shouldRewrite, if set, is consulted once the file has been opened and
+	// checked; returning false skips the file without counting a failure.
+	shouldRewrite func(path string, info os.FileInfo) bool
 }
 
 type pathResult struct {
 	path           string
 	outcome        pathOutcome
 	bytesRewritten int64
+	// size is the file size from stat, set for --dry-run results of paths
+	// that passed the file-type check.
+	size int64
+	err  error
+	// location is set for failures of files that were found on disk.
+	location *failureLocation
+	// sha256 is the hex SHA-256 of the data read back while rewriting, set
+	// with --manifest.
+	sha256 string
+	// manifest is the --compare-manifest check made before rewriting.
+	manifest manifestState
 }
 
 type runStats struct {
@@ -71,8 +269,44 @@ type runStats struct {
 	skippedNonRegular int
 	skippedHardlinks  int
 	skippedSparse     int
+	skippedFiltered   int
+	skippedReadOnly   int
+	timesNotRestored  int
+	touched           int
+	skippedClean      int
+	skippedLocked     int
+	manifestMismatch  int
+	manifestNew       int
+	notStarted        int
+	verifyFailures    int
 	failures          int
 	bytesRewritten    int64
+	// mismatchedPaths lists the files that did not match --compare-manifest.
+	mismatchedPaths []string
+}
+
+// batchProgress holds the counters sampled by --stats-interval. The rewrite
+// loop updates it while the reporter goroutine reads it, so all fields are
+// accessed atomically.
+type batchProgress struct {
+	totalFiles int
+	// totalBytes is the size of the selection, set for --progress-bar.
+	totalBytes int64
+	files      atomic.Int64
+	bytes      atomic.Int64
+	current    atomic.Pointer[string]
+}
+
+type fileExtent struct {
+	logical  uint64
+	physical uint64
+	length   uint64
+}
+
+// statFileInfo adapts a Stat_t for a regular file to os.FileInfo.
+type statFileInfo struct {
+	name string
+	sb   syscall.Stat_t
 }
 
 type hardLinkKey struct {
@@ -81,39 +315,180 @@ type hardLinkKey struct {
 }
 
 type cliOptions struct {
-	verbose         bool
+	verbosity       verbosityValue
 	bufferSizeMB    int
+	chunkSizeMB     int
 	dryRun          bool
+	countOnly       bool
+	json            bool
 	stats           bool
+	histogram       bool
+	statsInterval   time.Duration
+	progressBar     bool
+	deadline        time.Duration
+	atimeOlderThan  time.Duration
+	olderThan       time.Duration
+	newerThan       time.Duration
+	skipFstype      string
+	onlyFstype      string
+	until           string
+	color           string
+	onError         string
+	maxErrors       int
+	stride          int
 	dedupHardlinks  bool
 	skipSparse      bool
+	warnOnHoles     bool
+	respectLocks    bool
+	followSymlinks  bool
+	followFinal     bool
+	verifyRelocate  bool
+	verifyPass      bool
+	allowDevices    bool
+	paranoid        bool
+	skipReadOnly    bool
+	absPaths        bool
+	relativeTo      string
+	strictTimes     bool
+	followGrowth    bool
+	reverse         bool
+	noAtimeOpen     bool
+	touchOnly       bool
+	touchTime       string
+	setAtime        string
+	setMtime        string
+	skipIfClean     bool
+	autotune        bool
+	progressFD      int
+	excludeFrom     string
+	errorLogPath    string
+	retryFailed     string
+	workPlan        string
+	manifest        string
+	compareManifest string
+	glob            bool
+	shuffle         bool
+	seed            int64
+	simulateErrors  float64
+	ioDelay         time.Duration
+	globNomatchOK   bool
+	configPath      string
+	checkFirst      bool
+	keepGoing       bool
+	nice            int
+	ionice          bool
 	help            bool
 	selfupdate      bool
 	showVersionOnly bool
 }
 
+// verbosityValue is a counting flag value that also accepts explicit
+// booleans, so "--verbose=false" keeps working alongside "-vvv".
+type verbosityValue int
+
+func (v *verbosityValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosityValue) Set(s string) error {
+	switch s {
+	case "+1", "true":
+		*v++
+		return nil
+	case "false":
+		*v = 0
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid verbosity %q", s)
+	}
+	*v = verbosityValue(n)
+	return nil
+}
+
+func (v *verbosityValue) Type() string {
+	return "count"
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// resolveColor reports whether output to w should be colorized for the
+// given --color mode. NO_COLOR only overrides auto-detection, so an explicit
+// --color=always still wins.
+func resolveColor(mode string, w io.Writer) (bool, error) {
+	switch mode {
+	case colorAlways:
+		return true, nil
+	case colorNever:
+		return false, nil
+	case colorAuto:
+		if os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		return isTerminal(w), nil
+	}
+	return false, fmt.Errorf("invalid color mode %q: must be %s, %s, or %s", mode, colorAuto, colorAlways, colorNever)
+}
+
 func writeLine(w io.Writer, format string, args ...any) {
 	if w == nil {
 		return
 	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	// Clear a bar drawn in place so the line does not run into it. The bar
+	// is drawn again on its next redraw.
+	if drawnBar != nil {
+		_, _ = fmt.Fprint(drawnBar, "\r\x1b[K")
+		drawnBar = nil
+	}
 	_, _ = fmt.Fprintf(w, format+"\n", args...)
 }
 
+func writeColorLine(w io.Writer, color, format string, args ...any) {
+	if !colorEnabled {
+		writeLine(w, format, args...)
+		return
+	}
+	writeLine(w, "%s%s%s", color, fmt.Sprintf(format, args...), ansiReset)
+}
+
+// writeResult writes an uncolored result line to resultOutput.
+func writeResult(format string, args ...any) {
+	writeLine(resultOutput, format, args...)
+}
+
 func logWarning(format string, args ...any) {
-	writeLine(errorOutput, format, args...)
+	writeColorLine(errorOutput, ansiRed, format, args...)
 }
 
 func logInfo(format string, args ...any) {
 	writeLine(infoOutput, format, args...)
 }
 
+func logSkip(format string, args ...any) {
+	writeColorLine(infoOutput, ansiYellow, format, args...)
+}
+
 func logWarningWithError(err error, format string, args ...any) {
 	msg := fmt.Sprintf(format, args...)
-	writeLine(errorOutput, "%s: %v.", msg, err)
+	writeColorLine(errorOutput, ansiRed, "%s: %v.", msg, err)
 }
 
-func logVerbose(format string, args ...any) {
-	if !verbose {
+func logVerbose(level int, format string, args ...any) {
+	if verbosity < level {
 		return
 	}
 	writeLine(errorOutput, format, args...)
@@ -137,6 +512,61 @@ func isRegularFile(mode uint32) bool {
 	return (mode & syscall.S_IFMT) == syscall.S_IFREG
 }
 
+func isDeviceFile(mode uint32) bool {
+	fileType := mode & syscall.S_IFMT
+	return fileType == syscall.S_IFBLK || fileType == syscall.S_IFCHR
+}
+
+// isRewritableFile reports whether a file of this mode can be rewritten. With
+// allowDevices, that includes block devices and, where disks are character
+// devices, character devices.
+func isRewritableFile(mode uint32, allowDevices bool) bool {
+	if isRegularFile(mode) {
+		return true
+	}
+	if !allowDevices {
+		return false
+	}
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		return true
+	case syscall.S_IFCHR:
+		return charDevicesRewritable
+	}
+	return false
+}
+
+// logNotRewritable warns that path is being skipped because of its file
+// type. Named pipes and sockets, which turn up in mixed directories, are
+// named explicitly, as are character devices refused despite allowDevices.
+func logNotRewritable(path string, mode uint32, allowDevices bool) {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		if allowDevices {
+			logWarning("%s is a character device, which cannot be rewritten on Linux; use the block device instead, skipping.", path)
+			return
+		}
+		logWarning("%s is not a regular file, skipping.", path)
+	case syscall.S_IFIFO:
+		logWarning("%s is a named pipe, skipping.", path)
+	case syscall.S_IFSOCK:
+		logWarning("%s is a socket, skipping.", path)
+	default:
+		logWarning("%s is not a regular file, skipping.", path)
+	}
+}
+
+// notRewritableResult is the result for a path rejected because of its file
+// type: a failure, or with skip a SKIP NON-REGULAR skip without an error.
+func notRewritableResult(path string, mode uint32, allowDevices, skip bool) pathResult {
+	if skip {
+		logSkip("SKIP NON-REGULAR %s", path)
+		return pathResult{path: path, outcome: pathOutcomeSkippedNonRegular}
+	}
+	logNotRewritable(path, mode, allowDevices)
+	return failedResult(path, errNotRegular, nil)
+}
+
 func hardLinkKeyFromStat(sb *syscall.Stat_t) hardLinkKey {
 	return hardLinkKey{
 		dev: uint64(sb.Dev),
@@ -158,6 +588,21 @@ func trackHardLink(path string, sb *syscall.Stat_t, seen map[hardLinkKey]string)
 	return "", false
 }
 
+// deviceFilesystemType names the filesystem of the device sb lives on,
+// looking it up through fd only the first time that device is seen.
+func deviceFilesystemType(fd int, sb *syscall.Stat_t) string {
+	dev := uint64(sb.Dev)
+	if name, ok := filesystemTypes[dev]; ok {
+		return name
+	}
+	name, err := statfsType(fd)
+	if err != nil {
+		name = "unknown"
+	}
+	filesystemTypes[dev] = name
+	return name
+}
+
 func sameFileIdentity(a, b *syscall.Stat_t) bool {
 	return hardLinkKeyFromStat(a) == hardLinkKeyFromStat(b)
 }
@@ -169,250 +614,1398 @@ func allocatedFileBytes(sb *syscall.Stat_t) int64 {
 	return sb.Blocks * 512
 }
 
+// isSparseFile reports whether a regular file has fewer blocks allocated than
+// its size needs. Devices are never sparse: their size is that of the device,
+// while their block count is always 0.
 func isSparseFile(sb *syscall.Stat_t) bool {
+	if isDeviceFile(uint32(sb.Mode)) {
+		return false
+	}
 	return sb.Size > 0 && sb.Size > allocatedFileBytes(sb)
 }
 
+// warnIfHoles logs a warning if fd has a hole before size, since rewriting
+// the file writes back the zeros read from its holes and allocates them. It
+// costs one seek rather than a read of the file.
+func warnIfHoles(fd int, path string, size int64) {
+	hole, err := findHole(fd)
+	if err != nil {
+		logVerbose(verbositySyscalls, "Unable to check %s for holes: %v.", path, err)
+		return
+	}
+	if hole < size {
+		logWarning("%s is sparse (first hole at offset %d); rewriting it will allocate its holes.", path, hole)
+	}
+}
+
+// warnIfHolesAtPath is warnIfHoles for --dry-run, which does not otherwise
+// open files.
+func warnIfHolesAtPath(path string, size int64, followSymlinks bool) {
+	flags := syscall.O_RDONLY | syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+	if followSymlinks {
+		flags = syscall.O_RDONLY | syscall.O_NONBLOCK
+	}
+	fd, err := openFile(path, flags, 0)
+	if err != nil {
+		logVerbose(verbositySyscalls, "Unable to open %s to check for holes: %v.", path, err)
+		return
+	}
+	defer func() {
+		_ = closeFile(fd)
+	}()
+	warnIfHoles(fd, path, size)
+}
+
+func failedResult(path string, kind, cause error) pathResult {
+	outcome := pathOutcomeFailed
+	if kind == errNotRegular {
+		outcome = pathOutcomeRejectedNonRegular
+	}
+	return pathResult{path: path, outcome: outcome, err: &rewriteError{kind: kind, err: cause}}
+}
+
+// failedAtResult is failedResult for a read or write that failed at offset.
+func failedAtResult(path string, kind, cause error, offset int64) pathResult {
+	return pathResult{path: path, outcome: pathOutcomeFailed, err: &rewriteError{kind: kind, err: cause, offset: offset, hasOffset: true}}
+}
+
+func (r pathResult) failed() bool {
+	return r.outcome == pathOutcomeFailed || r.outcome == pathOutcomeRejectedNonRegular
+}
+
 func closeProcessedFile(fd int, path string, result pathResult) pathResult {
 	if err := closeFile(fd); err != nil {
 		logWarningWithError(err, "Unable to close %s", path)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+		return failedResult(path, errClose, err)
 	}
 	return result
 }
 
-func sparseSkipResult(path string, dryRun bool) pathResult {
-	if dryRun {
-		logInfo("WOULD SKIP SPARSE %s", path)
-	} else {
-		logInfo("SKIP SPARSE %s", path)
+func (fi statFileInfo) Name() string { return fi.name }
+func (fi statFileInfo) Size() int64  { return fi.sb.Size }
+func (fi statFileInfo) IsDir() bool  { return false }
+func (fi statFileInfo) Sys() any     { return &fi.sb }
+
+func (fi statFileInfo) Mode() os.FileMode {
+	mode := os.FileMode(fi.sb.Mode & 0o777)
+	if fi.sb.Mode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
 	}
-	return pathResult{path: path, outcome: pathOutcomeSkippedSparse}
+	if fi.sb.Mode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if fi.sb.Mode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
 }
 
-func rewriteOpenFile(fd int, path string, bufferSizeBytes int, sb *syscall.Stat_t) pathResult {
-	if bufferSizeBytes <= 0 {
-		logWarning("invalid rewrite buffer size %d bytes: must be greater than 0", bufferSizeBytes)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+func (fi statFileInfo) ModTime() time.Time {
+	_, mtime, ok := statTimes(&fi.sb)
+	if !ok {
+		return time.Time{}
 	}
+	return time.Unix(mtime.Unix())
+}
 
-	buf := make([]byte, bufferSizeBytes)
+func filteredOut(path string, sb *syscall.Stat_t, options processOptions) bool {
+	if options.shouldRewrite == nil {
+		return false
+	}
+	return !options.shouldRewrite(path, statFileInfo{name: filepath.Base(path), sb: *sb})
+}
 
-	var offset int64
-	for {
-		rdone, err := preadFile(fd, buf, offset)
-		if err != nil {
-			logWarningWithError(err, "Read from %s at offset %d failed", path, offset)
-			return pathResult{path: path, outcome: pathOutcomeFailed}
+// atimeFilter returns a --atime-older-than filter that keeps files last
+// accessed before cutoff. It warns once per filesystem that does not track
+// access times, since the filter cannot select anything meaningful there.
+func atimeFilter(cutoff time.Time) func(string, os.FileInfo) bool {
+	checked := make(map[uint64]bool)
+	return func(path string, info os.FileInfo) bool {
+		sb := info.Sys().(*syscall.Stat_t)
+		if dev := uint64(sb.Dev); !checked[dev] {
+			checked[dev] = true
+			if atimeUntracked(path) {
+				logWarning("%s is on a noatime mount, so --atime-older-than is selecting by stale access times.", path)
+			}
 		}
-		if rdone == 0 {
-			break
+		atime, _, ok := statTimes(sb)
+		if !ok {
+			return true
 		}
-		logVerbose("Read %d from %s at offset %d.", rdone, path, offset)
+		return time.Unix(atime.Unix()).Before(cutoff)
+	}
+}
 
-		written := 0
-		for written < rdone {
-			writeOffset := offset + int64(written)
-			remaining := rdone - written
+// mtimeFilter returns an --older-than/--newer-than filter that keeps files
+// last modified before olderCutoff and after newerCutoff. A zero cutoff does
+// not bound that side.
+func mtimeFilter(olderCutoff, newerCutoff time.Time) func(string, os.FileInfo) bool {
+	return func(_ string, info os.FileInfo) bool {
+		_, ts, ok := statTimes(info.Sys().(*syscall.Stat_t))
+		if !ok {
+			return true
+		}
+		mtime := time.Unix(ts.Unix())
+		if !olderCutoff.IsZero() && !mtime.Before(olderCutoff) {
+			return false
+		}
+		return newerCutoff.IsZero() || mtime.After(newerCutoff)
+	}
+}
 
-			wdone, err := pwriteFile(fd, buf[written:rdone], writeOffset)
-			if err != nil {
-				logWarningWithError(err, "Write %s at offset %d failed", path, writeOffset)
-				return pathResult{path: path, outcome: pathOutcomeFailed}
-			}
-			if wdone == 0 {
-				logWarning("Wrote nothing to %s at offset %d.", path, writeOffset)
-				return pathResult{path: path, outcome: pathOutcomeFailed}
+// fstypeFilter returns a --skip-fstype/--only-fstype filter that drops files
+// on the skip types and, if only is not empty, on any type not listed there.
+// skip takes precedence. The type is looked up once per device, through the
+// file itself so that a file on a mount point below its directory is placed
+// correctly.
+func fstypeFilter(skip, only []string, followSymlinks bool) func(string, os.FileInfo) bool {
+	return func(path string, info os.FileInfo) bool {
+		sb := info.Sys().(*syscall.Stat_t)
+		name, ok := filesystemTypes[uint64(sb.Dev)]
+		if !ok {
+			flags := syscall.O_RDONLY | syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+			if followSymlinks {
+				flags = syscall.O_RDONLY | syscall.O_NONBLOCK
 			}
-			logVerbose("Wrote %d to %s at offset %d.", wdone, path, writeOffset)
-			if wdone < remaining {
-				logWarning("Short write to %s at offset %d (wrote %d instead of %d).", path, writeOffset, wdone, remaining)
+			fd, err := openFile(path, flags, 0)
+			if err != nil {
+				logVerbose(verbositySyscalls, "Unable to open %s to check its filesystem type: %v.", path, err)
+				return true
 			}
-
-			written += wdone
+			name = deviceFilesystemType(fd, sb)
+			_ = closeFile(fd)
 		}
-
-		offset += int64(rdone)
+		if fstypeListed(skip, name) {
+			logVerbose(verbosityFiles, "%s is on a %s filesystem (--skip-fstype).", path, name)
+			return false
+		}
+		if len(only) > 0 && !fstypeListed(only, name) {
+			logVerbose(verbosityFiles, "%s is on a %s filesystem, not one of --only-fstype.", path, name)
+			return false
+		}
+		return true
 	}
+}
 
-	if err := syncFile(fd); err != nil {
-		logWarningWithError(err, "Unable to flush rewritten data on %s", path)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+// fstypeListed reports whether the filesystem type name matches one of list.
+// Names that cover several types, such as "ext2/ext3/ext4", match any of
+// their parts.
+func fstypeListed(list []string, name string) bool {
+	for _, want := range list {
+		if strings.EqualFold(want, name) {
+			return true
+		}
+		for _, part := range strings.Split(name, "/") {
+			if strings.EqualFold(want, part) {
+				return true
+			}
+		}
 	}
-	logVerbose("Flushed rewritten data on %s.", path)
+	return false
+}
 
-	atime, mtime, ok := statTimes(sb)
-	if !ok {
-		logWarning("Unable to restore access and modification times on %s: unsupported stat timestamp fields.", path)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+// warnFstypeConflicts warns about --only-fstype types that --skip-fstype
+// overrides, and about an allowlist that can select nothing.
+func warnFstypeConflicts(onlyValue string, skip, only []string) {
+	if onlyValue != "" && len(only) == 0 {
+		logWarning("--only-fstype %q names no filesystem types and is ignored", onlyValue)
+		return
 	}
-	if err := restoreFileTimes(fd, atime, mtime); err != nil {
-		logWarningWithError(err, "Unable to restore access and modification times on %s", path)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+	overridden := 0
+	for _, name := range only {
+		if fstypeListed(skip, name) {
+			logWarning("%s is in both --only-fstype and --skip-fstype; --skip-fstype takes precedence", name)
+			overridden++
+		}
 	}
-	logVerbose("Restored access and modification times on %s.", path)
-	if err := syncFile(fd); err != nil {
-		logWarningWithError(err, "Unable to flush restored timestamps on %s", path)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+	if len(only) > 0 && overridden == len(only) {
+		logWarning("--skip-fstype excludes every --only-fstype type, so no files will be selected")
 	}
-	logVerbose("Flushed restored timestamps on %s.", path)
+}
 
-	return pathResult{
-		path:           path,
-		outcome:        pathOutcomeRewritten,
-		bytesRewritten: offset,
+// parseFstypeList splits a comma-separated list of filesystem type names.
+func parseFstypeList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
 	}
+	return names
 }
 
-func inspectPath(path string) (syscall.Stat_t, pathResult, bool) {
-	var sb syscall.Stat_t
-	if err := lstatFile(path, &sb); err != nil {
-		logWarningWithError(err, "Unable to stat %s", path)
-		return syscall.Stat_t{}, pathResult{path: path, outcome: pathOutcomeFailed}, false
-	}
-	if !isRegularFile(uint32(sb.Mode)) {
-		logWarning("%s is not a regular file, skipping.", path)
-		return syscall.Stat_t{}, pathResult{path: path, outcome: pathOutcomeRejectedNonRegular}, false
+// atimeUntracked reports whether the filesystem holding path is mounted
+// without access time updates, checked through the parent directory so the
+// file itself is not opened.
+func atimeUntracked(path string) bool {
+	fd, err := openFile(filepath.Dir(originalPath(path)), syscall.O_RDONLY, 0)
+	if err != nil {
+		return false
 	}
-
-	return sb, pathResult{}, true
+	defer func() {
+		_ = closeFile(fd)
+	}()
+	return noAtimeMount(fd)
 }
 
-func processPath(path string, options processOptions, seen map[hardLinkKey]string) pathResult {
-	initialSB, result, ok := inspectPath(path)
-	if !ok {
-		return result
+func filterSkipResult(path string, dryRun bool) pathResult {
+	if dryRun {
+		logSkip("WOULD SKIP FILTERED %s", path)
+	} else {
+		logSkip("SKIP FILTERED %s", path)
 	}
+	return pathResult{path: path, outcome: pathOutcomeSkippedFiltered}
+}
 
-	if options.dryRun {
-		if options.skipSparse && isSparseFile(&initialSB) {
-			return sparseSkipResult(path, true)
-		}
-		if options.dedupHardlinks {
-			if firstPath, duplicate := trackHardLink(path, &initialSB, seen); duplicate {
-				logInfo("WOULD SKIP HARDLINK %s (same inode as %s)", path, firstPath)
-				return pathResult{path: path, outcome: pathOutcomeSkippedHardlink}
-			}
-		}
-
-		logInfo("WOULD REWRITE %s", path)
-		return pathResult{path: path, outcome: pathOutcomeWouldRewrite}
+func sparseSkipResult(path string, dryRun bool) pathResult {
+	if dryRun {
+		logSkip("WOULD SKIP SPARSE %s", path)
+	} else {
+		logSkip("SKIP SPARSE %s", path)
 	}
+	return pathResult{path: path, outcome: pathOutcomeSkippedSparse}
+}
 
-	fd, err := openFile(path, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+// lockedBy reports whether another process holds a lock on the file
+// described by sb, as --respect-locks checks before rewriting. Failing to
+// check is only a warning, and the file is then rewritten.
+func lockedBy(path string, sb *syscall.Stat_t) (string, bool) {
+	holder, locked, err := findFileLock(sb)
 	if err != nil {
-		logWarningWithError(err, "Unable to open %s", path)
-		return pathResult{path: path, outcome: pathOutcomeFailed}
+		logWarningWithError(err, "Unable to check %s for locks held by other processes", path)
+		return "", false
 	}
+	return holder, locked
+}
 
-	var openSB syscall.Stat_t
-	if err := fstatFile(fd, &openSB); err != nil {
-		logWarningWithError(err, "Unable to stat %s", path)
-		return closeProcessedFile(fd, path, pathResult{path: path, outcome: pathOutcomeFailed})
+func lockedSkipResult(path, holder string, dryRun bool) pathResult {
+	if dryRun {
+		logWarning("WOULD SKIP LOCKED %s: %s", path, holder)
+	} else {
+		logWarning("SKIP LOCKED %s: %s", path, holder)
 	}
-	if !isRegularFile(uint32(openSB.Mode)) {
-		logWarning("%s is not a regular file, skipping.", path)
-		return closeProcessedFile(fd, path, pathResult{path: path, outcome: pathOutcomeRejectedNonRegular})
+	return pathResult{path: path, outcome: pathOutcomeSkippedLocked}
+}
+
+func sameExtents(a, b []fileExtent) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	if !sameFileIdentity(&initialSB, &openSB) {
-		logWarning("%s changed identity between stat and open, skipping.", path)
-		return closeProcessedFile(fd, path, pathResult{path: path, outcome: pathOutcomeFailed})
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
-	if options.skipSparse && isSparseFile(&openSB) {
-		return closeProcessedFile(fd, path, sparseSkipResult(path, false))
+	return true
+}
+
+func extentMap(fd int, path string) ([]fileExtent, bool) {
+	extents, err := mapFileExtents(fd)
+	if err != nil {
+		logWarningWithError(err, "Unable to map extents of %s for relocation check", path)
+		return nil, false
 	}
+	logVerbose(verbositySyscalls, "Mapped %d extents on %s.", len(extents), path)
+	return extents, true
+}
 
-	if options.dedupHardlinks {
-		if firstPath, duplicate := trackHardLink(path, &openSB, seen); duplicate {
-			logVerbose("Skipping hard-link duplicate %s (same inode as %s).", path, firstPath)
-			return closeProcessedFile(fd, path, pathResult{path: path, outcome: pathOutcomeSkippedHardlink})
-		}
+func rewriteAndVerifyRelocation(fd int, path string, options processOptions, sb *syscall.Stat_t) pathResult {
+	before, mapped := extentMap(fd, path)
+	result := rewriteOpenFile(fd, path, options, sb)
+	if !mapped || result.outcome != pathOutcomeRewritten || len(before) == 0 {
+		return result
 	}
 
-	rewriteResult := rewriteOpenFile(fd, path, options.bufferSizeBytes, &openSB)
-	return closeProcessedFile(fd, path, rewriteResult)
+	after, mapped := extentMap(fd, path)
+	if mapped && sameExtents(before, after) {
+		logWarning("Rewrite of %s did not relocate any blocks; the filesystem kept the existing extents.", path)
+	}
+	return result
 }
 
-func (stats *runStats) add(result pathResult) {
-	stats.paths++
+// blockIO is the positioned I/O used by the rewrite loop. Both methods follow
+// pread(2) and pwrite(2): they may transfer fewer bytes than requested, and a
+// read of zero bytes with a nil error means end of file.
+type blockIO interface {
+	pread(buf []byte, offset int64) (int, error)
+	pwrite(buf []byte, offset int64) (int, error)
+}
 
-	switch result.outcome {
-	case pathOutcomeRewritten:
-		stats.rewritten++
-		stats.bytesRewritten += result.bytesRewritten
-	case pathOutcomeWouldRewrite:
-		stats.wouldRewrite++
-	case pathOutcomeSkippedHardlink:
-		stats.skippedHardlinks++
-	case pathOutcomeSkippedSparse:
-		stats.skippedSparse++
-	case pathOutcomeRejectedNonRegular:
-		stats.skippedNonRegular++
-		stats.failures++
-	case pathOutcomeFailed:
-		stats.failures++
-	}
+// fdIO is the blockIO for an open file descriptor.
+type fdIO int
+
+func (fd fdIO) pread(buf []byte, offset int64) (int, error) {
+	return preadFile(int(fd), buf, offset)
 }
 
-func (stats runStats) summaryLine() string {
-	return fmt.Sprintf(
-		"Summary: paths=%d rewritten=%d would_rewrite=%d skipped_non_regular=%d skipped_hardlinks=%d skipped_sparse=%d failures=%d bytes_rewritten=%d",
-		stats.paths,
-		stats.rewritten,
-		stats.wouldRewrite,
-		stats.skippedNonRegular,
-		stats.skippedHardlinks,
-		stats.skippedSparse,
-		stats.failures,
-		stats.bytesRewritten,
-	)
+func (fd fdIO) pwrite(buf []byte, offset int64) (int, error) {
+	return pwriteFile(int(fd), buf, offset)
 }
 
-func rewriteFile(path string, bufferSizeBytes int) bool {
-	return processPath(path, processOptions{bufferSizeBytes: bufferSizeBytes}, nil).outcome == pathOutcomeRewritten
+// cachedBlockIO is implemented by blockIOs whose reads may be served from the
+// page cache. evict flushes a written range and drops it from the cache, so
+// that reading it back checks the device rather than memory.
+type cachedBlockIO interface {
+	evict(offset, length int64) error
 }
 
-func newFlagSet(stderr io.Writer) (*flag.FlagSet, *cliOptions) {
-	options := &cliOptions{
-		bufferSizeMB: 8,
+func (fd fdIO) evict(offset, length int64) error {
+	return evictCachedPages(int(fd), offset, length)
+}
+
+// evictCachedPages flushes fd and drops [offset, offset+length) from the page
+// cache, widened to whole pages. A length of 0 means to the end of the file.
+// Only a failed flush is returned: where pages cannot be dropped, reads
+// still come from the cache, which is logged at -vvv.
+func evictCachedPages(fd int, offset, length int64) error {
+	if err := syncFile(fd); err != nil {
+		return err
+	}
+	if length > 0 {
+		page := int64(os.Getpagesize())
+		end := (offset + length + page - 1) / page * page
+		offset = offset / page * page
+		length = end - offset
+	}
+	if err := dropCachedPages(fd, offset, length); err != nil {
+		logVerbose(verbositySyscalls, "posix_fadvise(DONTNEED) offset=%d length=%d: %v; reading back from the page cache.", offset, length, err)
 	}
+	return nil
+}
 
-	fs := flag.NewFlagSet(appName, flag.ContinueOnError)
-	fs.SetOutput(stderr)
-	fs.BoolVarP(&options.verbose, "verbose", "v", false, "enable verbose output")
-	fs.IntVarP(&options.bufferSizeMB, "buffersize", "b", 8, "buffer size in MB")
+// writeChunk writes all of chunk at offset, continuing after short writes at
+// the correct offset. A write that makes no progress is retried up to
+// maxZeroWriteRetries times before the file is failed.
+func writeChunk(rw blockIO, path string, chunk []byte, offset int64, options processOptions, total int64, verifyBuf []byte) (pathResult, bool) {
+	written := 0
+	zeroWrites := 0
+	for written < len(chunk) {
+		writeOffset := offset + int64(written)
+		remaining := len(chunk) - written
+
+		wdone, err := rw.pwrite(chunk[written:], writeOffset)
+		if err != nil {
+			logWarningWithError(err, "Write %s at offset %d failed", path, writeOffset)
+			return failedAtResult(path, errWrite, err, writeOffset), false
+		}
+		if wdone == 0 {
+			zeroWrites++
+			if zeroWrites > maxZeroWriteRetries {
+				logWarning("Unable to complete write to %s at offset %d: no progress after %d attempts (%d of %d bytes in this chunk written).", path, writeOffset, zeroWrites, written, len(chunk))
+				return failedAtResult(path, errWrite, io.ErrShortWrite, writeOffset), false
+			}
+			logVerbose(verbosityChunks, "Wrote nothing to %s at offset %d, retrying.", path, writeOffset)
+			continue
+		}
+		zeroWrites = 0
+		logVerbose(verbosityChunks, "Wrote %d to %s at offset %d.", wdone, path, writeOffset)
+		if wdone < remaining {
+			logWarning("Short write to %s at offset %d (wrote %d instead of %d); writing the remainder.", path, writeOffset, wdone, remaining)
+		}
+		if verifyBuf != nil {
+			if result, ok := verifyWrite(rw, path, chunk[written:written+wdone], writeOffset, verifyBuf); !ok {
+				return result, false
+			}
+		}
+
+		written += wdone
+		options.progress.addBytes(wdone)
+		if options.progressFunc != nil {
+			options.progressFunc(path, offset+int64(written), total)
+		}
+	}
+	return pathResult{}, true
+}
+
+// verifyWrite reads back a just-written range and compares it with the bytes
+// that were written, reporting the first offset that differs. When rw reads
+// through the page cache, the range is flushed and dropped from the cache
+// first, so the comparison is against what reached the device.
+func verifyWrite(rw blockIO, path string, want []byte, offset int64, verifyBuf []byte) (pathResult, bool) {
+	if cached, ok := rw.(cachedBlockIO); ok {
+		if err := cached.evict(offset, int64(len(want))); err != nil {
+			logWarningWithError(err, "Unable to flush %s before verifying offset %d", path, offset)
+			return failedAtResult(path, errVerify, err, offset), false
+		}
+	}
+	got := verifyBuf[:len(want)]
+	read := 0
+	for read < len(got) {
+		n, err := rw.pread(got[read:], offset+int64(read))
+		if err != nil {
+			logWarningWithError(err, "Verify read from %s at offset %d failed", path, offset+int64(read))
+			return failedAtResult(path, errVerify, err, offset+int64(read)), false
+		}
+		if n == 0 {
+			logWarning("Verify read from %s at offset %d returned no data.", path, offset+int64(read))
+			return failedAtResult(path, errVerify, io.ErrUnexpectedEOF, offset+int64(read)), false
+		}
+		read += n
+	}
+
+	if !bytes.Equal(got, want) {
+		for i := range got {
+			if got[i] != want[i] {
+				logWarning("Verification of %s failed: data read back at offset %d does not match what was written.", path, offset+int64(i))
+				return failedAtResult(path, errVerify, nil, offset+int64(i)), false
+			}
+		}
+	}
+	logVerbose(verbosityChunks, "Verified %d bytes of %s at offset %d.", len(want), path, offset)
+	return pathResult{}, true
+}
+
+// rewriteBlocks reads rw in buffer-sized blocks and writes each block back in
+// place, returning the number of bytes rewritten. When bounded, it stops at
+// size; otherwise it continues until a read returns nothing. With a stride
+// above 1, only the first of every stride blocks is read and written back.
+// It does no flushing or timestamp handling, so it can run against any
+// blockIO.
+func rewriteBlocks(rw blockIO, path string, size int64, bounded bool, options processOptions) (int64, pathResult, bool) {
+	bufferSizeBytes := options.bufferSizeBytes
+	if bufferSizeBytes <= 0 {
+		logWarning("invalid rewrite buffer size %d bytes: must be greater than 0", bufferSizeBytes)
+		return 0, failedResult(path, errBufferSize, nil), false
+	}
+
+	buf := make([]byte, bufferSizeBytes)
+	var verifyBuf []byte
+	if options.paranoid {
+		verifyBuf = make([]byte, bufferSizeBytes)
+	}
+	if options.reverse {
+		return rewriteBlocksReverse(rw, path, size, options, buf, verifyBuf)
+	}
+
+	var offset, written int64
+	for block := 0; ; block++ {
+		readBuf := buf
+		if bounded {
+			remaining := size - offset
+			if remaining <= 0 {
+				break
+			}
+			if remaining < int64(len(readBuf)) {
+				readBuf = buf[:remaining]
+			}
+		}
+		if strideSkips(options.stride, block) {
+			logVerbose(verbosityChunks, "Skipping %d bytes of %s at offset %d (--stride).", len(readBuf), path, offset)
+			offset += int64(len(readBuf))
+			continue
+		}
+
+		if options.ioDelay > 0 {
+			time.Sleep(options.ioDelay)
+		}
+		rdone, err := rw.pread(readBuf, offset)
+		if err != nil {
+			logWarningWithError(err, "Read from %s at offset %d failed", path, offset)
+			return written, failedAtResult(path, errRead, err, offset), false
+		}
+		if rdone == 0 {
+			break
+		}
+		logVerbose(verbosityChunks, "Read %d from %s at offset %d.", rdone, path, offset)
+		if options.readHash != nil {
+			options.readHash.Write(buf[:rdone])
+		}
+		// A short read is not treated as end of file: the bytes that were
+		// read are written back and the next read continues right after
+		// them. Only a zero-byte read, or reaching the fstat size, ends the
+		// loop.
+		if bounded && rdone < len(readBuf) {
+			logVerbose(verbosityChunks, "Short read from %s at offset %d (%d of %d bytes); continuing.", path, offset, rdone, len(readBuf))
+		}
+
+		step := rdone
+		if options.chunkSizeBytes > 0 && options.chunkSizeBytes < rdone {
+			step = options.chunkSizeBytes
+		}
+		for start := 0; start < rdone; start += step {
+			end := min(start+step, rdone)
+			if result, ok := writeChunk(rw, path, buf[start:end], offset+int64(start), options, size, verifyBuf); !ok {
+				return written, result, false
+			}
+		}
+
+		offset += int64(rdone)
+		written += int64(rdone)
+	}
+	return written, pathResult{}, true
+}
+
+// strideSkips reports whether --stride leaves block, counted from the first
+// block rewritten, untouched.
+func strideSkips(stride, block int) bool {
+	return stride > 1 && block%stride != 0
+}
+
+// rewriteBlocksReverse is the --reverse form of rewriteBlocks. It rewrites
+// the first size bytes in buffer-sized blocks from the end of the file back
+// to offset 0, so the block at offset 0 holds any remainder. Each block is
+// read in full before it is written back. Progress is reported as the
+// number of bytes done so far, as in the forward loop.
+func rewriteBlocksReverse(rw blockIO, path string, size int64, options processOptions, buf, verifyBuf []byte) (int64, pathResult, bool) {
+	var done int64
+	for index, end := 0, size; end > 0; index++ {
+		start := max(end-int64(len(buf)), 0)
+		if strideSkips(options.stride, index) {
+			logVerbose(verbosityChunks, "Skipping %d bytes of %s at offset %d (--stride).", end-start, path, start)
+			end = start
+			continue
+		}
+		if options.ioDelay > 0 {
+			time.Sleep(options.ioDelay)
+		}
+		block := buf[:end-start]
+		read := 0
+		for read < len(block) {
+			n, err := rw.pread(block[read:], start+int64(read))
+			if err != nil {
+				logWarningWithError(err, "Read from %s at offset %d failed", path, start+int64(read))
+				return done, failedAtResult(path, errRead, err, start+int64(read)), false
+			}
+			if n == 0 {
+				break
+			}
+			read += n
+		}
+		logVerbose(verbosityChunks, "Read %d from %s at offset %d.", read, path, start)
+		if read < len(block) {
+			// The file shrank; write back only what is still there.
+			logVerbose(verbosityChunks, "Short read from %s at offset %d (%d of %d bytes); continuing.", path, start, read, len(block))
+		}
+
+		blockOptions := options
+		if options.progressFunc != nil {
+			base := done
+			blockOptions.progressFunc = func(path string, position, total int64) {
+				options.progressFunc(path, base+position-start, total)
+			}
+		}
+		step := read
+		if options.chunkSizeBytes > 0 && options.chunkSizeBytes < read {
+			step = options.chunkSizeBytes
+		}
+		for chunkStart := 0; chunkStart < read; chunkStart += step {
+			chunkEnd := min(chunkStart+step, read)
+			if result, ok := writeChunk(rw, path, block[chunkStart:chunkEnd], start+int64(chunkStart), blockOptions, size, verifyBuf); !ok {
+				return done, result, false
+			}
+		}
+
+		done += int64(read)
+		end = start
+	}
+	return done, pathResult{}, true
+}
+
+func rewriteOpenFile(fd int, path string, options processOptions, sb *syscall.Stat_t) pathResult {
+	// Devices, and files unless --follow-growth was given, are rewritten up to
+	// the size reported by fstat rather than until a read returns nothing, so
+	// data appended during the rewrite is left alone.
+	device := isDeviceFile(uint32(sb.Mode))
+	bounded := device || !options.followGrowth
+
+	if options.hashContent {
+		options.readHash = sha256.New()
+	}
+	start := time.Now()
+	offset, result, ok := rewriteBlocks(fdIO(fd), path, sb.Size, bounded, options)
+	if !ok {
+		return result
+	}
+	elapsed := time.Since(start)
+	var contentHash string
+	if options.readHash != nil {
+		contentHash = hex.EncodeToString(options.readHash.Sum(nil))
+	}
+
+	if err := syncFile(fd); err != nil {
+		logWarningWithError(err, "Unable to flush rewritten data on %s", path)
+		return failedResult(path, errSync, err)
+	}
+	logVerbose(verbosityChunks, "Flushed rewritten data on %s.", path)
+
+	if device {
+		logVerbose(verbosityChunks, "Skipping timestamp restore on device %s.", path)
+	} else if result, ok := restoreTimes(fd, path, options, sb); !ok {
+		if options.strictTimes {
+			return result
+		}
+		// The data itself is intact, so a failed timestamp restore is only
+		// a warning unless --strict-times was given.
+		logWarning("%s was rewritten, but its original timestamps may not have been restored.", path)
+		result.outcome = pathOutcomeRewrittenTimesNotRestored
+		result.bytesRewritten = offset
+		result.sha256 = contentHash
+		logVerbose(verbosityFiles, "Rewrote %s: %s.", path, throughput(offset, elapsed))
+		return result
+	}
+
+	logVerbose(verbosityFiles, "Rewrote %s: %s.", path, throughput(offset, elapsed))
+	return pathResult{
+		path:           path,
+		outcome:        pathOutcomeRewritten,
+		bytesRewritten: offset,
+		sha256:         contentHash,
+	}
+}
+
+// throughput describes n bytes transferred in elapsed, e.g.
+// "512.0 MB in 3.1s (165.2 MB/s)" or "4.0 KB in 0.3ms (12.5 MB/s)".
+func throughput(n int64, elapsed time.Duration) string {
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(n) / elapsed.Seconds()
+	}
+	duration := fmt.Sprintf("%.1fs", elapsed.Seconds())
+	if elapsed < time.Second {
+		duration = fmt.Sprintf("%.1fms", float64(elapsed)/float64(time.Millisecond))
+	}
+	return fmt.Sprintf("%s in %s (%s/s)", formatBytes(float64(n)), duration, formatBytes(rate))
+}
+
+// formatBytes describes n bytes in the largest unit, up to TB, that keeps the
+// value at least 1, e.g. "512 B" or "165.2 MB". Units are powers of 1024.
+func formatBytes(n float64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	units := []string{"KB", "MB", "GB", "TB"}
+	unit := 0
+	for n /= 1024; n >= 1024 && unit < len(units)-1; n /= 1024 {
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[unit])
+}
+
+// restoreTimes writes back the access and modification times from sb, or the
+// replacements from --set-atime and --set-mtime.
+func restoreTimes(fd int, path string, options processOptions, sb *syscall.Stat_t) (pathResult, bool) {
+	atime, mtime, ok := statTimes(sb)
+	if !ok {
+		logWarning("Unable to restore access and modification times on %s: unsupported stat timestamp fields.", path)
+		return failedResult(path, errTimestamp, nil), false
+	}
+	if !options.setAtime.IsZero() {
+		atime = syscall.NsecToTimespec(options.setAtime.UnixNano())
+	} else if noAtimeMount(fd) {
+		// Access times are not tracked on this mount, so only restore mtime.
+		atime = syscall.Timespec{Nsec: utimeOmit}
+		logVerbose(verbosityChunks, "%s is on a noatime mount; leaving access time untouched.", path)
+	}
+	if !options.setMtime.IsZero() {
+		mtime = syscall.NsecToTimespec(options.setMtime.UnixNano())
+	}
+	logVerbose(verbositySyscalls, "Restoring atime=%d.%09d mtime=%d.%09d on %s (read from %s, written with %s).", atime.Sec, atime.Nsec, mtime.Sec, mtime.Nsec, path, statTimeFields, restoreTimesMethod)
+	if err := restoreFileTimes(fd, atime, mtime); err != nil {
+		logWarningWithError(err, "Unable to restore access and modification times on %s", path)
+		return failedResult(path, errTimestamp, err), false
+	}
+	logVerbose(verbosityChunks, "Restored access and modification times on %s.", path)
+	if err := syncFile(fd); err != nil {
+		logWarningWithError(err, "Unable to flush restored timestamps on %s", path)
+		return failedResult(path, errSync, err), false
+	}
+	logVerbose(verbosityChunks, "Flushed restored timestamps on %s.", path)
+	return pathResult{}, true
+}
+
+// touchOpenFile applies the --touch-only timestamp policy without reading or
+// writing any data.
+func touchOpenFile(fd int, path string, options processOptions, sb *syscall.Stat_t) pathResult {
+	if result, ok := restoreTimes(fd, path, options, sb); !ok {
+		return result
+	}
+	logVerbose(verbosityFiles, "Touched %s.", path)
+	return pathResult{path: path, outcome: pathOutcomeTouched}
+}
+
+func inspectPath(path string, stat func(string, *syscall.Stat_t) error, allowDevices, skipNonRegular bool) (syscall.Stat_t, pathResult, bool) {
+	var sb syscall.Stat_t
+	if err := stat(path, &sb); err != nil {
+		logWarningWithError(err, "Unable to stat %s", path)
+		return syscall.Stat_t{}, failedResult(path, errStat, err), false
+	}
+	if !isRewritableFile(uint32(sb.Mode), allowDevices) {
+		return syscall.Stat_t{}, notRewritableResult(path, uint32(sb.Mode), allowDevices, skipNonRegular), false
+	}
+
+	return sb, pathResult{}, true
+}
+
+// statFor returns the stat function matching how paths will be opened:
+// lstat(2) by default, stat(2) with --follow-symlinks, and a stat that only
+// follows the final component with --follow-final.
+func statFor(followSymlinks, followFinal bool) func(string, *syscall.Stat_t) error {
+	switch {
+	case followFinal:
+		return statFollowingFinal
+	case followSymlinks:
+		return statFile
+	}
+	return lstatFile
+}
+
+// canonicalPath returns an absolute path with directory symlinks resolved.
+// The final component is only resolved when symlinks are being followed, so
+// a symlink argument is still rejected without --follow-symlinks. Paths that
+// cannot be resolved are returned unchanged.
+func canonicalPath(path string, followSymlinks bool) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if followSymlinks {
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			return resolved
+		}
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs
+	}
+	return filepath.Join(dir, filepath.Base(abs))
+}
+
+// countSelection applies the same stat checks and filters as a dry run to
+// paths without logging each one, returning how many files would be rewritten
+// and their combined size. ok is false if any path could not be inspected.
+func countSelection(paths []string, options processOptions) (int, int64, bool) {
+	dedup := options.dedupHardlinks || options.followSymlinks || options.followFinal
+	seen := make(map[hardLinkKey]string)
+	files := 0
+	var size int64
+	ok := true
+	for _, path := range paths {
+		sb, _, valid := inspectPath(path, statFor(options.followSymlinks, options.followFinal), options.allowDevices, options.skipNonRegular)
+		if !valid {
+			ok = false
+			continue
+		}
+		if options.skipSparse && isSparseFile(&sb) {
+			continue
+		}
+		if filteredOut(path, &sb, options) {
+			continue
+		}
+		if dedup {
+			if _, duplicate := trackHardLink(path, &sb, seen); duplicate {
+				continue
+			}
+		}
+		if options.respectLocks {
+			if _, locked := lockedBy(path, &sb); locked {
+				continue
+			}
+		}
+		files++
+		size += sb.Size
+	}
+	return files, size, ok
+}
+
+// reportedPaths maps each path in its --relative-to form back to the path it
+// was given as. It is nil without --relative-to.
+var reportedPaths map[string]string
+
+// originalPath returns the path to open for a path as it is reported. Only
+// the default openFile, lstatFile and statFile translate paths, so the rest
+// of the code can use the reported form throughout.
+func originalPath(path string) string {
+	if original, ok := reportedPaths[path]; ok {
+		return original
+	}
+	return path
+}
+
+// relativizePaths rewrites paths relative to base for reporting and returns
+// the map from each new form back to the original path, which is still the
+// one opened. Both sides are resolved with canonicalPath first so ".." steps
+// do not cross symlinked directories.
+func relativizePaths(paths []string, base string, followSymlinks bool) (map[string]string, error) {
+	resolvedBase, err := filepath.EvalSymlinks(base)
+	if err == nil {
+		resolvedBase, err = filepath.Abs(resolvedBase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid --relative-to directory %s: %w", base, err)
+	}
+	if info, err := os.Stat(resolvedBase); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("invalid --relative-to directory %s: not a directory", base)
+	}
+
+	originals := make(map[string]string, len(paths))
+	for i, path := range paths {
+		rel, err := filepath.Rel(resolvedBase, canonicalPath(path, followSymlinks))
+		if err != nil {
+			return nil, fmt.Errorf("unable to make %s relative to %s: %w", path, base, err)
+		}
+		originals[rel] = path
+		paths[i] = rel
+	}
+	return originals, nil
+}
+
+// shufflePaths reorders paths in place. The order depends only on seed and
+// the number of paths, so the same seed reproduces a run.
+func shufflePaths(paths []string, seed int64) {
+	r := rand.New(rand.NewPCG(uint64(seed), 0))
+	r.Shuffle(len(paths), func(i, j int) {
+		paths[i], paths[j] = paths[j], paths[i]
+	})
+}
+
+// expandGlobs replaces each argument containing a wildcard with the paths it
+// matches, in sorted order. Other arguments are passed through unchanged.
+func expandGlobs(args []string, nomatchOK bool) ([]string, error) {
+	paths := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			if !nomatchOK {
+				return nil, fmt.Errorf("glob pattern %q matched no files", arg)
+			}
+			logVerbose(verbosityFiles, "Glob pattern %s matched no files.", arg)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// preflightPaths inspects every path before any file is opened, reporting
+// each missing or non-regular path so they can all be fixed in one go. With
+// skipNonRegular, non-regular paths are returned as skipped rather than
+// failed results.
+func preflightPaths(paths []string, stat func(string, *syscall.Stat_t) error, allowDevices, skipNonRegular bool) ([]string, []pathResult) {
+	valid := make([]string, 0, len(paths))
+	var invalid []pathResult
+	for _, path := range paths {
+		if _, result, ok := inspectPath(path, stat, allowDevices, skipNonRegular); !ok {
+			invalid = append(invalid, result)
+			continue
+		}
+		valid = append(valid, path)
+	}
+	return valid, invalid
+}
+
+// dryRunPath reports what processPath would do with a path that passed
+// inspectPath, without opening it.
+func dryRunPath(path string, sb *syscall.Stat_t, options processOptions, dedup bool, seen map[hardLinkKey]string) pathResult {
+	if options.skipSparse && isSparseFile(sb) {
+		return sparseSkipResult(path, true)
+	}
+	if filteredOut(path, sb, options) {
+		return filterSkipResult(path, true)
+	}
+	if dedup {
+		if firstPath, duplicate := trackHardLink(path, sb, seen); duplicate {
+			logSkip("WOULD SKIP HARDLINK %s (same inode as %s)", path, firstPath)
+			return pathResult{path: path, outcome: pathOutcomeSkippedHardlink}
+		}
+	}
+	if options.respectLocks {
+		if holder, locked := lockedBy(path, sb); locked {
+			return lockedSkipResult(path, holder, true)
+		}
+	}
+
+	if options.touchOnly {
+		logInfo("WOULD TOUCH %s", path)
+	} else {
+		logInfo("WOULD REWRITE %s", path)
+		if options.warnOnHoles && !isDeviceFile(uint32(sb.Mode)) {
+			warnIfHolesAtPath(path, sb.Size, options.followSymlinks || options.followFinal)
+		}
+	}
+	return pathResult{path: path, outcome: pathOutcomeWouldRewrite}
+}
+
+func processPath(path string, options processOptions, seen map[hardLinkKey]string) pathResult {
+	if options.simulateErrors > 0 && rand.Float64() < options.simulateErrors {
+		logWarning("Simulated failure for %s (--simulate-error-rate); the file was not touched.", path)
+		return failedResult(path, errSimulated, nil)
+	}
+
+	initialSB, result, ok := inspectPath(path, statFor(options.followSymlinks, options.followFinal), options.allowDevices, options.skipNonRegular)
+	if !ok {
+		return result
+	}
+
+	// Following symlinks can reach the same target through several paths, so
+	// inode dedup is always applied in that mode.
+	dedup := options.dedupHardlinks || options.followSymlinks || options.followFinal
+
+	if options.dryRun {
+		result := dryRunPath(path, &initialSB, options, dedup, seen)
+		result.size = initialSB.Size
+		return result
+	}
+
+	// O_NONBLOCK keeps the open from hanging if the path was replaced by a
+	// FIFO after the stat check. processOpenFile clears it again once fstat
+	// has shown the file can be rewritten.
+	openFlags := defaultOpenFlags
+	if options.openFlags != 0 {
+		openFlags = options.openFlags
+	}
+	open := openFile
+	if options.followFinal {
+		open = openFollowingFinal
+	}
+	openPath := func(flags int) (int, error) {
+		if !options.noAtimeOpen || openNoAtime == 0 {
+			return open(path, flags, 0)
+		}
+		fd, err := open(path, flags|openNoAtime, 0)
+		if errors.Is(err, syscall.EPERM) {
+			// O_NOATIME is only permitted for the file's owner.
+			logVerbose(verbositySyscalls, "O_NOATIME not permitted on %s, opening without it.", path)
+			fd, err = open(path, flags, 0)
+		}
+		return fd, err
+	}
+	fd, err := openPath(openFlags | syscall.O_NONBLOCK)
+	if errors.Is(err, syscall.EWOULDBLOCK) && initialSB.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		// With O_NONBLOCK, a lease held by another process fails the open
+		// instead of waiting for the lease to be broken. The stat check
+		// found a regular file, so wait for it with a blocking open.
+		logVerbose(verbosityFiles, "%s is leased by another process; waiting for the lease to be released.", path)
+		fd, err = openPath(openFlags)
+	}
+	if errors.Is(err, syscall.EROFS) {
+		if options.skipReadOnly {
+			logSkip("SKIP READONLY %s", path)
+			return pathResult{path: path, outcome: pathOutcomeSkippedReadOnly}
+		}
+		logWarning("%s is on a read-only filesystem, skipping.", path)
+		return failedResult(path, errOpen, err)
+	}
+	if err != nil {
+		logWarningWithError(err, "Unable to open %s", path)
+		return withFailureLocation(failedResult(path, errOpen, err), -1, &initialSB)
+	}
+
+	result = processOpenFile(fd, path, options, &initialSB, seen)
+	if result.outcome == pathOutcomeFailed {
+		result = withFailureLocation(result, fd, &initialSB)
+	}
+	return closeProcessedFile(fd, path, result)
+}
+
+// processOpenFile runs the checks and the rewrite of processPath on a file
+// that is already open for reading and writing, so callers that open files
+// with flags of their own can reuse it. fd is left open. When initialSB is
+// not nil, the file must still match that earlier lstat or stat result.
+func processOpenFile(fd int, path string, options processOptions, initialSB *syscall.Stat_t, seen map[hardLinkKey]string) pathResult {
+	dedup := options.dedupHardlinks || options.followSymlinks || options.followFinal
+
+	var openSB syscall.Stat_t
+	if err := fstatFile(fd, &openSB); err != nil {
+		logWarningWithError(err, "Unable to stat %s", path)
+		return failedResult(path, errStat, err)
+	}
+	logVerbose(verbositySyscalls, "fstat %s: dev=%d ino=%d mode=%#o size=%d blocks=%d.", path, uint64(openSB.Dev), uint64(openSB.Ino), openSB.Mode, openSB.Size, openSB.Blocks)
+	if verbosity >= verbosityChunks {
+		logVerbose(verbosityChunks, "%s is on a %s filesystem.", path, deviceFilesystemType(fd, &openSB))
+	}
+	if !isRewritableFile(uint32(openSB.Mode), options.allowDevices) {
+		return notRewritableResult(path, uint32(openSB.Mode), options.allowDevices, options.skipNonRegular)
+	}
+	if initialSB != nil && !sameFileIdentity(initialSB, &openSB) {
+		logWarning("%s changed identity between stat and open, skipping.", path)
+		return failedResult(path, errIdentityChanged, nil)
+	}
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		logWarningWithError(err, "Unable to clear O_NONBLOCK on %s", path)
+		return failedResult(path, errOpen, err)
+	}
+	if isDeviceFile(uint32(openSB.Mode)) {
+		size, err := deviceSize(fd, &openSB)
+		if err != nil {
+			logWarningWithError(err, "Unable to determine size of device %s", path)
+			return failedResult(path, errDeviceSize, err)
+		}
+		openSB.Size = size
+		logWarning("Rewriting device %s in place (%d bytes).", path, size)
+	}
+	if options.skipSparse && isSparseFile(&openSB) {
+		return sparseSkipResult(path, false)
+	}
+	if filteredOut(path, &openSB, options) {
+		return filterSkipResult(path, false)
+	}
+
+	if dedup {
+		if firstPath, duplicate := trackHardLink(path, &openSB, seen); duplicate {
+			logVerbose(verbosityFiles, "Skipping hard-link duplicate %s (same inode as %s).", path, firstPath)
+			return pathResult{path: path, outcome: pathOutcomeSkippedHardlink}
+		}
+	}
+	if options.respectLocks {
+		if holder, locked := lockedBy(path, &openSB); locked {
+			return lockedSkipResult(path, holder, false)
+		}
+	}
+
+	if options.touchOnly {
+		return touchOpenFile(fd, path, options, &openSB)
+	}
+	if options.warnOnHoles && !isDeviceFile(uint32(openSB.Mode)) {
+		warnIfHoles(fd, path, openSB.Size)
+	}
+
+	if options.knownHashes != nil {
+		checked, result, ok := compareManifest(fd, path, options, &openSB)
+		if !ok {
+			return result
+		}
+		result = rewriteContent(fd, path, options, &openSB)
+		result.manifest = checked
+		return result
+	}
+	return rewriteContent(fd, path, options, &openSB)
+}
+
+// rewriteContent rewrites the data of the open file fd once every check in
+// processOpenFile has passed. openSB is its fstat result, with the size of a
+// device filled in.
+func rewriteContent(fd int, path string, options processOptions, openSB *syscall.Stat_t) pathResult {
+	if openSB.Size == 0 {
+		logVerbose(verbosityFiles, "%s is empty, nothing to rewrite.", path)
+		var emptyHash string
+		if options.hashContent {
+			sum := sha256.Sum256(nil)
+			emptyHash = hex.EncodeToString(sum[:])
+		}
+		// Nothing is read or written, so the original timestamps are still
+		// in place and only --set-atime or --set-mtime needs applying.
+		if !options.setAtime.IsZero() || !options.setMtime.IsZero() {
+			if result, ok := restoreTimes(fd, path, options, openSB); !ok {
+				if options.strictTimes {
+					return result
+				}
+				logWarning("%s is empty, but its timestamps may not have been set.", path)
+				result.outcome = pathOutcomeRewrittenTimesNotRestored
+				result.sha256 = emptyHash
+				return result
+			}
+		}
+		return pathResult{path: path, outcome: pathOutcomeRewritten, sha256: emptyHash}
+	}
+
+	var contentHash string
+	if options.skipIfClean {
+		hash, result, ok := hashOpenFile(fd, path, options, openSB)
+		if !ok {
+			return result
+		}
+		stored, err := readContentMarker(fd)
+		if err != nil {
+			logVerbose(verbosityFiles, "Unable to read content marker on %s: %v.", path, err)
+		} else if stored != "" {
+			if storedHash, ok := parseContentMarker(stored); !ok {
+				logVerbose(verbosityFiles, "Ignoring content marker on %s written by an incompatible version.", path)
+			} else if storedHash == hash {
+				logSkip("SKIP CLEAN %s", path)
+				return pathResult{path: path, outcome: pathOutcomeSkippedClean}
+			}
+		}
+		contentHash = hash
+	}
+
+	var rewriteResult pathResult
+	if options.verifyRelocate {
+		rewriteResult = rewriteAndVerifyRelocation(fd, path, options, openSB)
+	} else {
+		rewriteResult = rewriteOpenFile(fd, path, options, openSB)
+	}
+	if contentHash != "" && !rewriteResult.failed() {
+		if err := writeContentMarker(fd, contentMarkerValue(contentHash)); err != nil {
+			logWarningWithError(err, "Unable to store content marker on %s", path)
+		} else {
+			logVerbose(verbosityChunks, "Stored content marker %s on %s.", contentHash, path)
+		}
+	}
+	return rewriteResult
+}
+
+// contentMarkerValue formats hash for the content marker extended attribute.
+func contentMarkerValue(hash string) string {
+	return contentMarkerVersion + ":" + hash
+}
+
+// parseContentMarker returns the hash in a stored content marker. It
+// reports false for markers in another format, including the bare hashes
+// written before markers were versioned.
+func parseContentMarker(stored string) (string, bool) {
+	version, hash, ok := strings.Cut(stored, ":")
+	if !ok || version != contentMarkerVersion {
+		return "", false
+	}
+	return hash, true
+}
+
+// hashOpenFile returns the hex SHA-256 of the first sb.Size bytes of fd.
+func hashOpenFile(fd int, path string, options processOptions, sb *syscall.Stat_t) (string, pathResult, bool) {
+	if options.bufferSizeBytes <= 0 {
+		logWarning("invalid rewrite buffer size %d bytes: must be greater than 0", options.bufferSizeBytes)
+		return "", failedResult(path, errBufferSize, nil), false
+	}
+
+	h := sha256.New()
+	buf := make([]byte, options.bufferSizeBytes)
+	for offset := int64(0); offset < sb.Size; {
+		readBuf := buf
+		if remaining := sb.Size - offset; remaining < int64(len(readBuf)) {
+			readBuf = buf[:remaining]
+		}
+		n, err := preadFile(fd, readBuf, offset)
+		if err != nil {
+			logWarningWithError(err, "Read from %s at offset %d failed", path, offset)
+			return "", failedAtResult(path, errRead, err, offset), false
+		}
+		if n == 0 {
+			break
+		}
+		h.Write(readBuf[:n])
+		offset += int64(n)
+	}
+	return hex.EncodeToString(h.Sum(nil)), pathResult{}, true
+}
+
+func (stats *runStats) add(result pathResult) {
+	stats.paths++
+	switch result.manifest {
+	case manifestMismatch:
+		stats.manifestMismatch++
+		stats.mismatchedPaths = append(stats.mismatchedPaths, result.path)
+	case manifestNew:
+		stats.manifestNew++
+	}
+
+	switch result.outcome {
+	case pathOutcomeRewritten:
+		stats.rewritten++
+		stats.bytesRewritten += result.bytesRewritten
+	case pathOutcomeRewrittenTimesNotRestored:
+		stats.rewritten++
+		stats.timesNotRestored++
+		stats.bytesRewritten += result.bytesRewritten
+	case pathOutcomeTouched:
+		stats.touched++
+	case pathOutcomeWouldRewrite:
+		stats.wouldRewrite++
+	case pathOutcomeSkippedHardlink:
+		stats.skippedHardlinks++
+	case pathOutcomeSkippedSparse:
+		stats.skippedSparse++
+	case pathOutcomeSkippedFiltered:
+		stats.skippedFiltered++
+	case pathOutcomeSkippedReadOnly:
+		stats.skippedReadOnly++
+	case pathOutcomeSkippedClean:
+		stats.skippedClean++
+	case pathOutcomeSkippedLocked:
+		stats.skippedLocked++
+	case pathOutcomeRejectedNonRegular:
+		stats.skippedNonRegular++
+		stats.failures++
+	case pathOutcomeSkippedNonRegular:
+		stats.skippedNonRegular++
+	case pathOutcomeFailed:
+		stats.failures++
+	}
+}
+
+func (stats runStats) summaryLine() string {
+	return fmt.Sprintf(
+		"Summary: paths=%d rewritten=%d would_rewrite=%d skipped_non_regular=%d skipped_hardlinks=%d skipped_sparse=%d failures=%d bytes_rewritten=%d skipped_filtered=%d skipped_readonly=%d times_not_restored=%d touched=%d skipped_clean=%d not_started=%d verify_failures=%d skipped_locked=%d manifest_mismatches=%d manifest_new=%d",
+		stats.paths,
+		stats.rewritten,
+		stats.wouldRewrite,
+		stats.skippedNonRegular,
+		stats.skippedHardlinks,
+		stats.skippedSparse,
+		stats.failures,
+		stats.bytesRewritten,
+		stats.skippedFiltered,
+		stats.skippedReadOnly,
+		stats.timesNotRestored,
+		stats.touched,
+		stats.skippedClean,
+		stats.notStarted,
+		stats.verifyFailures,
+		stats.skippedLocked,
+		stats.manifestMismatch,
+		stats.manifestNew,
+	)
+}
+
+func (p *batchProgress) addBytes(n int) {
+	if p == nil {
+		return
+	}
+	p.bytes.Add(int64(n))
+}
+
+func (p *batchProgress) fileDone() {
+	if p == nil {
+		return
+	}
+	p.files.Add(1)
+}
+
+func (p *batchProgress) line(intervalBytes int64, interval time.Duration) string {
+	files := p.files.Load()
+	rate := 0.0
+	if interval > 0 {
+		rate = float64(intervalBytes) / bytesPerMB / interval.Seconds()
+	}
+	return fmt.Sprintf(
+		"Progress: files_done=%d files_remaining=%d bytes_done=%d mb_per_sec=%.2f",
+		files,
+		int64(p.totalFiles)-files,
+		p.bytes.Load(),
+		rate,
+	)
+}
+
+// startReporting logs a progress line every interval until the returned stop
+// function is called. The rate covers only the most recent interval.
+func (p *batchProgress) startReporting(interval time.Duration) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastBytes := int64(0)
+		lastTick := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				bytes := p.bytes.Load()
+				logInfo("%s", p.line(bytes-lastBytes, now.Sub(lastTick)))
+				lastBytes = bytes
+				lastTick = now
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// rewriteFile rewrites a single path in place. The returned error matches one
+// of the err* sentinels above with errors.Is. A failed timestamp restore is
+// still returned as an error even though the data was rewritten.
+func rewriteFile(path string, bufferSizeBytes int) error {
+	return processPath(path, processOptions{bufferSizeBytes: bufferSizeBytes}, nil).err
+}
+
+func newFlagSet(stderr io.Writer) (*flag.FlagSet, *cliOptions) {
+	options := &cliOptions{
+		bufferSizeMB: 8,
+	}
+
+	fs := flag.NewFlagSet(appName, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.VarP(&options.verbosity, "verbose", "v", "increase verbosity (repeat as -vv or -vvv for more detail)")
+	fs.Lookup("verbose").NoOptDefVal = "+1"
+	fs.IntVarP(&options.bufferSizeMB, "buffersize", "b", 8, "buffer size in MB")
+	fs.IntVar(&options.chunkSizeMB, "chunk-size", 0, "write each buffer in pieces of this many MB, updating progress after each (default: the whole buffer)")
 	fs.BoolVarP(&options.dryRun, "dry-run", "n", false, "report files that would be rewritten without modifying them")
+	fs.BoolVar(&options.json, "json", false, "with --dry-run, print the plan to stdout as one JSON object per path")
+	fs.BoolVar(&options.countOnly, "count-only", false, "print the number and total size of the files that would be rewritten, then exit")
 	fs.BoolVar(&options.stats, "stats", false, "print summary statistics after processing")
+	fs.BoolVar(&options.histogram, "histogram", false, "print the number and total size of processed files per power-of-two size bucket after processing")
+	fs.BoolVar(&options.checkFirst, "check-first", false, "check that every path exists and is a regular file before rewriting anything")
+	fs.BoolVar(&options.keepGoing, "keep-going", false, "with --check-first, rewrite the valid paths even if some are invalid")
+	fs.DurationVar(&options.statsInterval, "stats-interval", 0, "log progress statistics at this interval, e.g. 30s (0 disables)")
+	fs.BoolVar(&options.progressBar, "progress-bar", false, "show a progress bar for the whole run with percent done, ETA, and the current file")
+	fs.IntVar(&options.progressFD, "progress-fd", 0, "write JSON progress events to this already-open file descriptor")
+	fs.DurationVar(&options.deadline, "deadline", 0, "stop starting new files once this much time has passed, e.g. 2h (0 disables)")
+	fs.StringVar(&options.until, "until", "", "stop starting new files after this local time of day, e.g. 06:00")
+	fs.StringVar(&options.color, "color", colorAuto, "colorize output: auto, always, or never")
+	fs.IntVar(&options.maxErrors, "max-errors", 0, "stop once this many paths have failed (0 means no limit)")
+	fs.StringVar(&options.onError, "on-error", onErrorContinue, "what to do when a path fails: continue, skip (also treat non-regular files as skips), or abort")
+	fs.BoolVar(&options.glob, "glob", false, "expand shell-style wildcards in path arguments, for callers that do not use a shell")
+	fs.BoolVar(&options.shuffle, "shuffle", false, "process paths in random order")
+	fs.Int64Var(&options.seed, "seed", 0, "with --shuffle, seed the random order so a run can be repeated (default: a random seed, which is logged)")
+	fs.BoolVar(&options.globNomatchOK, "glob-nomatch-ok", false, "with --glob, ignore patterns that match nothing instead of failing")
+	fs.DurationVar(&options.atimeOlderThan, "atime-older-than", 0, "only rewrite files last accessed longer ago than this, e.g. 720h (0 disables)")
+	fs.StringVar(&options.skipFstype, "skip-fstype", "", "skip files on these comma-separated filesystem types, e.g. tmpfs,nfs")
+	fs.StringVar(&options.onlyFstype, "only-fstype", "", "only rewrite files on these comma-separated filesystem types, e.g. ext4,xfs")
+	fs.DurationVar(&options.olderThan, "older-than", 0, "only rewrite files last modified longer ago than this, e.g. 168h (0 disables)")
+	fs.DurationVar(&options.newerThan, "newer-than", 0, "only rewrite files last modified more recently than this, e.g. 720h (0 disables)")
+	fs.StringVar(&options.excludeFrom, "exclude-from", "", "skip paths matching any glob pattern listed in this file, one per line")
 	fs.BoolVar(&options.dedupHardlinks, "dedup-hardlinks", false, "skip duplicate hard-linked files within a single run")
 	fs.BoolVar(&options.skipSparse, "skip-sparse", false, "skip files that appear sparse instead of rewriting them")
+	fs.BoolVar(&options.respectLocks, "respect-locks", false, "skip files locked by another process, as listed in /proc/locks (Linux only)")
+	fs.BoolVar(&options.warnOnHoles, "warn-on-holes", false, "warn about files with holes (found with SEEK_HOLE) that a rewrite would allocate")
+	fs.BoolVar(&options.skipReadOnly, "skip-readonly", false, "skip files on read-only filesystems instead of treating them as failures")
+	fs.BoolVar(&options.absPaths, "abspath", false, "report paths as absolute, symlink-resolved paths")
+	fs.StringVar(&options.relativeTo, "relative-to", "", "report paths relative to this directory")
+	fs.BoolVar(&options.followSymlinks, "follow-symlinks", false, "rewrite the targets of symlinks instead of rejecting them")
+	fs.BoolVar(&options.followFinal, "follow-final", false, "follow a symlink in the last path component only, rejecting symlinked directories (Linux only)")
+	fs.BoolVar(&options.strictTimes, "strict-times", false, "treat a failed timestamp restore after a successful rewrite as a failure")
+	fs.BoolVar(&options.autotune, "autotune", false, "benchmark a few buffer sizes in the first path's directory and use the fastest")
+	fs.BoolVar(&options.reverse, "reverse", false, "rewrite each file in buffer-sized blocks from the end back to the start")
+	fs.IntVar(&options.stride, "stride", 1, "rewrite only one buffer-sized block in every N, skipping the rest (a sample, not a full refresh)")
+	fs.BoolVar(&options.followGrowth, "follow-growth", false, "keep rewriting data appended while a file is being rewritten instead of stopping at its original size")
+	fs.BoolVar(&options.touchOnly, "touch-only", false, "only apply the timestamp policy to each file without rewriting any data")
+	fs.StringVar(&options.touchTime, "time", "", "with --touch-only, set access and modification times to \"now\", an RFC 3339 timestamp, or epoch seconds instead of keeping them")
+	fs.StringVar(&options.setAtime, "set-atime", "", "set the access time to this value instead of restoring it (\"now\", RFC 3339, or epoch seconds)")
+	fs.StringVar(&options.setMtime, "set-mtime", "", "set the modification time to this value instead of restoring it (\"now\", RFC 3339, or epoch seconds)")
+	fs.BoolVar(&options.skipIfClean, "skip-if-clean", false, "skip files whose content hash matches the one stored in an xattr by the previous rewrite")
+	fs.BoolVar(&options.noAtimeOpen, "noatime-open", false, "open files with O_NOATIME so reading them does not update atime (Linux only)")
+	fs.BoolVar(&options.paranoid, "paranoid", false, "read back and compare every chunk immediately after writing it")
+	fs.BoolVar(&options.verifyPass, "verify-pass", false, "after rewriting every file, read each rewritten file again end to end")
+	fs.BoolVar(&options.verifyRelocate, "verify-relocation", false, "warn when a rewrite leaves the file's physical extents unchanged (Linux FIEMAP)")
+	fs.StringVar(&options.errorLogPath, "error-log", "", "append the path and error of every failed file to this file")
+	fs.StringVar(&options.manifest, "manifest", "", "write a sha256sum-compatible manifest of every rewritten file, hashed while it is read")
+	fs.StringVar(&options.compareManifest, "compare-manifest", "", "check each file against the hash in this sha256sum manifest before rewriting it, and report mismatches")
+	fs.StringVar(&options.workPlan, "plan", "", "process the paths in this JSON list of {\"path\", \"size\"} objects, in order, instead of path arguments")
+	fs.StringVar(&options.retryFailed, "retry-failed", "", "also process every path listed in this --error-log file from an earlier run")
+	fs.StringVar(&options.configPath, "config", "", "read default options from this JSON file (default: "+appName+"/"+configFileName+" in the user config directory)")
+	fs.BoolVar(&options.allowDevices, "allow-devices", false, "DANGEROUS: also rewrite block and character devices in place")
+	fs.IntVar(&options.nice, "nice", 0, "lower CPU priority to this nice value, 0 to 19 (Linux only)")
+	fs.BoolVar(&options.ionice, "ionice", false, "run with the idle I/O priority class (Linux only)")
 	fs.BoolVar(&options.selfupdate, "selfupdate", false, "check for updates and replace this executable if a newer release is available")
-	fs.BoolVar(&options.showVersionOnly, "version", false, "show the current version")
+	fs.BoolVar(&options.showVersionOnly, "version", false, "show the version, commit, and Go version of this build")
+	fs.Float64Var(&options.simulateErrors, "simulate-error-rate", 0, "TESTING: fail this fraction of paths, from 0 to 1, without touching them")
+	_ = fs.MarkHidden("simulate-error-rate")
+	fs.DurationVar(&options.ioDelay, "io-delay", 0, "TESTING: sleep this long before reading each buffer, simulating a slow device")
+	_ = fs.MarkHidden("io-delay")
 	fs.BoolVarP(&options.help, "help", "h", false, "show help")
 	fs.Usage = func() {
-		_, _ = fmt.Fprintf(fs.Output(), "Usage of %s:\n", appName)
-		_, _ = fmt.Fprintf(fs.Output(), "  %s [flags] file ...\n", appName)
-		fs.VisitAll(func(f *flag.Flag) {
-			typeName := ""
-			if f.Value.Type() != "bool" {
-				typeName = " " + f.Value.Type()
-			}
-
-			flagLabel := fmt.Sprintf("--%s%s", f.Name, typeName)
-			if f.Shorthand != "" {
-				flagLabel = fmt.Sprintf("-%s, --%s%s", f.Shorthand, f.Name, typeName)
-			}
-			_, _ = fmt.Fprintf(fs.Output(), "  %-24s %s", flagLabel, f.Usage)
-			if f.DefValue != "" && f.DefValue != "false" {
-				_, _ = fmt.Fprintf(fs.Output(), " (default %s)", f.DefValue)
-			}
-			_, _ = fmt.Fprintln(fs.Output())
-		})
+		printUsage(fs)
 	}
 	return fs, options
 }
 
 func run(args []string, stdout, stderr io.Writer) int {
-	verbose = false
+	verbosity = 0
+	colorEnabled = false
+	reportedPaths = nil
+	filesystemTypes = map[uint64]string{}
 	if stdout == nil {
 		stdout = io.Discard
 	}
@@ -421,14 +2014,19 @@ func run(args []string, stdout, stderr io.Writer) int {
 	}
 	infoOutput = stderr
 	errorOutput = stderr
+	resultOutput = stdout
 
 	fs, cli := newFlagSet(stderr)
 
-	if err := fs.Parse(args); err != nil {
+	normalized, err := normalizeGoStyleLongFlags(fs, args)
+	if err == nil {
+		err = fs.Parse(normalized)
+	}
+	if err != nil {
+		logWarning("%v (see --help)", err)
 		return 2
 	}
 
-	verbose = cli.verbose
 	if cli.help {
 		fs.Usage()
 		return 0
@@ -441,52 +2039,641 @@ func run(args []string, stdout, stderr io.Writer) int {
 		return 0
 	}
 	if cli.showVersionOnly {
-		_, _ = fmt.Fprintln(stdout, appVersion)
+		writeResult("%s", versionText())
 		return 0
 	}
 
+	given := givenFlags(fs)
+	configPath := cli.configPath
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+	if configPath != "" {
+		values, err := loadConfig(configPath, cli.configPath != "")
+		if err == nil {
+			err = applyConfig(fs, values, given)
+		}
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+	}
+
+	verbosity = int(cli.verbosity)
+	useColor, err := resolveColor(cli.color, stderr)
+	if err != nil {
+		logWarning("%v", err)
+		return 2
+	}
+	colorEnabled = useColor
+
 	paths := fs.Args()
-	if len(paths) == 0 {
+	if len(paths) == 0 && cli.retryFailed == "" && cli.workPlan == "" {
 		fs.Usage()
 		return 2
 	}
+	if cli.workPlan != "" && (len(paths) > 0 || cli.retryFailed != "" || cli.shuffle) {
+		logWarning("--plan sets the paths and their order, so it cannot be used with path arguments, --retry-failed, or --shuffle")
+		return 2
+	}
+	if cli.glob {
+		paths, err = expandGlobs(paths, cli.globNomatchOK)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+		// With --glob-nomatch-ok every pattern may have been dropped, and
+		// nothing below may assume a path is left.
+		if len(paths) == 0 && cli.retryFailed == "" {
+			logSkip("0 files processed: 0 of 0 paths were filtered out.")
+			writeColorLine(infoOutput, ansiGreen, "%s", runStats{}.summaryLine())
+			return exitNothingRewritten
+		}
+	}
+	if cli.retryFailed != "" {
+		// Appending the new failures to the log being retried would mix
+		// them with the old ones.
+		if retryInfo, err := os.Stat(cli.retryFailed); err == nil && cli.errorLogPath != "" {
+			if errorLogInfo, err := os.Stat(cli.errorLogPath); err == nil && os.SameFile(retryInfo, errorLogInfo) {
+				logWarning("--error-log must name a different file than --retry-failed")
+				return 2
+			}
+		}
+		failed, err := readFailureLog(cli.retryFailed)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+		if len(paths)+len(failed) == 0 {
+			logSkip("%s lists no failed paths; nothing to retry.", cli.retryFailed)
+			return exitNothingRewritten
+		}
+		logVerbose(verbosityFiles, "Retrying %d failed paths from %s.", len(failed), cli.retryFailed)
+		paths = append(paths, failed...)
+	}
+	// Paths from --plan are used as listed, without --glob expansion.
+	// planBytes is their total size, used instead of statting every path for
+	// --progress-bar.
+	var planBytes int64
+	if cli.workPlan != "" {
+		paths, planBytes, err = readWorkPlan(cli.workPlan)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+		if len(paths) == 0 {
+			logSkip("%s lists no paths; nothing to do.", cli.workPlan)
+			return exitNothingRewritten
+		}
+		logVerbose(verbosityFiles, "Processing %d paths from %s.", len(paths), cli.workPlan)
+	}
+	if cli.shuffle {
+		if !fs.Changed("seed") {
+			cli.seed = rand.Int64()
+		}
+		logInfo("Shuffling %d paths with --seed %d.", len(paths), cli.seed)
+		shufflePaths(paths, cli.seed)
+	}
+	if !given["buffersize"] {
+		if value := os.Getenv(bufferSizeEnv); value != "" {
+			sizeMB, err := strconv.Atoi(value)
+			if err != nil {
+				logWarning("invalid %s %q: must be a buffer size in MB", bufferSizeEnv, value)
+				return 2
+			}
+			cli.bufferSizeMB = sizeMB
+		}
+	}
 	bufferSizeBytes, err := bufferSizeBytesFromMB(cli.bufferSizeMB)
 	if err != nil {
 		logWarning("%v", err)
 		return 2
 	}
+	if cli.deadline < 0 {
+		logWarning("invalid deadline %s: must not be negative", cli.deadline)
+		return 2
+	}
+	if cli.deadline > 0 && cli.until != "" {
+		logWarning("--deadline and --until cannot be used together")
+		return 2
+	}
+	var deadline time.Time
+	if cli.deadline > 0 {
+		deadline = time.Now().Add(cli.deadline)
+	} else if cli.until != "" {
+		deadline, err = untilDeadline(time.Now(), cli.until)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+	}
+	if cli.simulateErrors < 0 || cli.simulateErrors > 1 {
+		logWarning("invalid simulated error rate %g: must be between 0 and 1", cli.simulateErrors)
+		return 2
+	}
+	if cli.ioDelay < 0 {
+		logWarning("invalid I/O delay %s: must not be negative", cli.ioDelay)
+		return 2
+	}
+	if cli.chunkSizeMB < 0 || cli.chunkSizeMB > cli.bufferSizeMB {
+		logWarning("invalid chunk size %d MB: must be between 0 and the buffer size (%d MB)", cli.chunkSizeMB, cli.bufferSizeMB)
+		return 2
+	}
+	switch cli.onError {
+	case onErrorContinue, onErrorSkip, onErrorAbort:
+	default:
+		logWarning("invalid --on-error policy %q: must be %s, %s, or %s", cli.onError, onErrorContinue, onErrorSkip, onErrorAbort)
+		return 2
+	}
+	if cli.maxErrors < 0 {
+		logWarning("invalid --max-errors %d: must not be negative", cli.maxErrors)
+		return 2
+	}
+	if cli.atimeOlderThan < 0 {
+		logWarning("invalid --atime-older-than %s: must not be negative", cli.atimeOlderThan)
+		return 2
+	}
+	if cli.olderThan < 0 || cli.newerThan < 0 {
+		logWarning("invalid --older-than %s or --newer-than %s: must not be negative", cli.olderThan, cli.newerThan)
+		return 2
+	}
+	if cli.olderThan > 0 && cli.newerThan > 0 && cli.newerThan <= cli.olderThan {
+		logWarning("--older-than %s --newer-than %s selects no files: --newer-than must be longer than --older-than", cli.olderThan, cli.newerThan)
+	}
+	if cli.statsInterval < 0 {
+		logWarning("invalid stats interval %s: must not be negative", cli.statsInterval)
+		return 2
+	}
+	if cli.progressFD < 0 {
+		logWarning("invalid progress fd %d: must not be negative", cli.progressFD)
+		return 2
+	}
+	if cli.stride < 1 {
+		logWarning("invalid --stride %d: must be at least 1", cli.stride)
+		return 2
+	}
+	if cli.skipIfClean && !contentMarkersSupported {
+		logWarning("--skip-if-clean stores content hashes in extended attributes, which are only supported on Linux")
+		return 2
+	}
+	if cli.stride > 1 && cli.skipIfClean {
+		logWarning("--stride and --skip-if-clean cannot be used together")
+		return 2
+	}
+	if cli.followFinal {
+		switch {
+		case !followFinalSupported:
+			logWarning("--follow-final is only supported on Linux")
+			return 2
+		case cli.followSymlinks:
+			logWarning("--follow-final and --follow-symlinks cannot be used together")
+			return 2
+		case cli.absPaths || cli.relativeTo != "":
+			logWarning("--follow-final cannot be combined with --abspath or --relative-to, which resolve directory symlinks before the check")
+			return 2
+		}
+	}
+	if cli.manifest != "" && (cli.reverse || cli.stride > 1 || cli.dryRun || cli.touchOnly) {
+		logWarning("--manifest needs every file read from start to end, so it cannot be used with --reverse, --stride, --dry-run, or --touch-only")
+		return 2
+	}
+	if cli.compareManifest != "" && (cli.dryRun || cli.touchOnly) {
+		logWarning("--compare-manifest reads the files it rewrites, so it cannot be used with --dry-run or --touch-only")
+		return 2
+	}
+	if cli.reverse && cli.followGrowth {
+		logWarning("--reverse and --follow-growth cannot be used together")
+		return 2
+	}
+	if cli.json && !cli.dryRun {
+		logWarning("--json requires --dry-run")
+		return 2
+	}
+	if cli.json && cli.countOnly {
+		logWarning("--json and --count-only cannot be used together")
+		return 2
+	}
+	if cli.touchTime != "" && !cli.touchOnly {
+		logWarning("--time requires --touch-only")
+		return 2
+	}
+	// --time sets both timestamps; --set-atime and --set-mtime override it.
+	var setAtime, setMtime time.Time
+	for _, value := range []struct {
+		flag string
+		text string
+		dst  []*time.Time
+	}{
+		{"time", cli.touchTime, []*time.Time{&setAtime, &setMtime}},
+		{"set-atime", cli.setAtime, []*time.Time{&setAtime}},
+		{"set-mtime", cli.setMtime, []*time.Time{&setMtime}},
+	} {
+		if value.text == "" {
+			continue
+		}
+		t, err := parseTimeValue(value.text)
+		if err != nil {
+			logWarning("invalid --%s %q: %v", value.flag, value.text, err)
+			return 2
+		}
+		for _, dst := range value.dst {
+			*dst = t
+		}
+	}
+	var excludePatterns []string
+	if cli.excludeFrom != "" {
+		excludePatterns, err = loadExcludePatterns(cli.excludeFrom)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+	}
+	var events *progressStream
+	if cli.progressFD > 0 {
+		fd, err := openProgressFD(cli.progressFD)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+		events = newProgressStream(fd)
+	}
+	if cli.nice < 0 || cli.nice > 19 {
+		logWarning("invalid nice value %d: must be between 0 and 19", cli.nice)
+		return 2
+	}
+	if err := lowerPriority(cli.nice, cli.ionice); err != nil {
+		logWarning("Unable to lower process priority: %v.", err)
+		return 1
+	}
+
+	if cli.autotune {
+		if cli.dryRun || cli.countOnly {
+			logVerbose(verbosityFiles, "Skipping buffer size autotune when not rewriting.")
+		} else if len(paths) == 0 {
+			logVerbose(verbosityFiles, "Skipping buffer size autotune with no paths to process.")
+		} else if tuned, err := autotuneBufferSize(filepath.Dir(paths[0]), autotuneCandidatesMB); err != nil {
+			logWarning("Unable to autotune buffer size, using %d MB: %v.", bufferSizeBytes/bytesPerMB, err)
+		} else {
+			bufferSizeBytes = tuned
+			logVerbose(verbosityFiles, "Autotune selected a %d MB buffer.", bufferSizeBytes/bytesPerMB)
+		}
+	}
+
+	if cli.absPaths {
+		for i, path := range paths {
+			paths[i] = canonicalPath(path, cli.followSymlinks)
+		}
+	}
+
+	var errorLog *failureLog
+	if cli.errorLogPath != "" {
+		errorLog, err = openFailureLog(cli.errorLogPath)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+		defer errorLog.close()
+	}
+
+	if cli.relativeTo != "" {
+		if cli.absPaths {
+			logWarning("--abspath and --relative-to cannot be used together")
+			return 2
+		}
+		reportedPaths, err = relativizePaths(paths, cli.relativeTo, cli.followSymlinks)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+	}
+
+	var knownHashes map[string]string
+	if cli.compareManifest != "" {
+		knownHashes, err = readManifest(cli.compareManifest)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+	}
+	var manifest *manifestWriter
+	if cli.manifest != "" {
+		manifest, err = createManifest(cli.manifest)
+		if err != nil {
+			logWarning("%v", err)
+			return 2
+		}
+		defer manifest.close()
+	}
+
+	runStart := time.Now()
+	run := runStats{}
+	ret := 0
+	var plan *planWriter
+	if cli.json {
+		plan = newPlanWriter(resultOutput, cli.touchOnly)
+	}
+	if cli.checkFirst {
+		valid, invalid := preflightPaths(paths, statFor(cli.followSymlinks, cli.followFinal), cli.allowDevices, cli.onError == onErrorSkip)
+		failed := 0
+		for _, result := range invalid {
+			if result.failed() {
+				failed++
+			}
+		}
+		if failed > 0 && !cli.keepGoing {
+			logWarning("%d of %d paths failed the preflight check; nothing was rewritten.", failed, len(paths))
+			return 2
+		}
+		for _, result := range invalid {
+			run.add(result)
+			plan.add(result)
+			if result.failed() {
+				errorLog.add(result.path, result.err)
+				ret = 1
+			}
+		}
+		paths = valid
+	}
 
+	openFlags := 0
+	if cli.followSymlinks {
+		openFlags = syscall.O_RDWR
+	}
 	process := processOptions{
 		bufferSizeBytes: bufferSizeBytes,
+		chunkSizeBytes:  cli.chunkSizeMB * bytesPerMB,
 		dryRun:          cli.dryRun,
 		dedupHardlinks:  cli.dedupHardlinks,
 		skipSparse:      cli.skipSparse,
+		warnOnHoles:     cli.warnOnHoles,
+		respectLocks:    cli.respectLocks,
+		followSymlinks:  cli.followSymlinks,
+		followFinal:     cli.followFinal,
+		openFlags:       openFlags,
+		verifyRelocate:  cli.verifyRelocate,
+		allowDevices:    cli.allowDevices,
+		paranoid:        cli.paranoid,
+		skipReadOnly:    cli.skipReadOnly,
+		strictTimes:     cli.strictTimes,
+		followGrowth:    cli.followGrowth,
+		reverse:         cli.reverse,
+		stride:          cli.stride,
+		hashContent:     cli.manifest != "",
+		knownHashes:     knownHashes,
+		noAtimeOpen:     cli.noAtimeOpen,
+		touchOnly:       cli.touchOnly,
+		setAtime:        setAtime,
+		setMtime:        setMtime,
+		skipIfClean:     cli.skipIfClean,
+		simulateErrors:  cli.simulateErrors,
+		skipNonRegular:  cli.onError == onErrorSkip,
+		ioDelay:         cli.ioDelay,
+	}
+	var filters []func(string, os.FileInfo) bool
+	if len(excludePatterns) > 0 {
+		filters = append(filters, func(path string, _ os.FileInfo) bool {
+			return !excludedBy(excludePatterns, path)
+		})
+	}
+	if cli.atimeOlderThan > 0 {
+		filters = append(filters, atimeFilter(time.Now().Add(-cli.atimeOlderThan)))
+	}
+	skipFstypes, onlyFstypes := parseFstypeList(cli.skipFstype), parseFstypeList(cli.onlyFstype)
+	warnFstypeConflicts(cli.onlyFstype, skipFstypes, onlyFstypes)
+	if len(skipFstypes) > 0 || len(onlyFstypes) > 0 {
+		filters = append(filters, fstypeFilter(skipFstypes, onlyFstypes, cli.followSymlinks || cli.followFinal))
+	}
+	if cli.olderThan > 0 || cli.newerThan > 0 {
+		var olderCutoff, newerCutoff time.Time
+		if cli.olderThan > 0 {
+			olderCutoff = time.Now().Add(-cli.olderThan)
+		}
+		if cli.newerThan > 0 {
+			newerCutoff = time.Now().Add(-cli.newerThan)
+		}
+		filters = append(filters, mtimeFilter(olderCutoff, newerCutoff))
+	}
+	if len(filters) > 0 {
+		process.shouldRewrite = func(path string, info os.FileInfo) bool {
+			for _, keep := range filters {
+				if !keep(path, info) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	if cli.countOnly {
+		files, size, ok := countSelection(paths, process)
+		writeResult("files=%d bytes=%d", files, size)
+		if !ok {
+			return 1
+		}
+		return ret
+	}
+	if events != nil {
+		process.progressFunc = events.fileProgress
+	}
+	stopReporting := func() {}
+	// The bar would not move when no data is written, and --json keeps the
+	// output machine-readable.
+	progressBar := cli.progressBar && !cli.dryRun && !cli.touchOnly && !cli.json
+	if cli.statsInterval > 0 || progressBar {
+		process.progress = &batchProgress{totalFiles: len(paths)}
+	}
+	if cli.statsInterval > 0 {
+		stopReporting = process.progress.startReporting(cli.statsInterval)
+	}
+	if progressBar {
+		if cli.workPlan != "" {
+			process.progress.totalBytes = planBytes
+		} else {
+			process.progress.totalBytes = selectionSize(paths, cli.followSymlinks || cli.followFinal)
+		}
+		stopStats, stopBar := stopReporting, process.progress.startBar(infoOutput, isTerminal(infoOutput))
+		stopReporting = func() {
+			stopStats()
+			stopBar()
+		}
 	}
 	seenHardLinks := make(map[hardLinkKey]string)
-	run := runStats{}
+	var histogram *sizeHistogram
+	// --touch-only rewrites no data, so there are no sizes to bucket.
+	if cli.histogram && !cli.touchOnly {
+		histogram = &sizeHistogram{}
+	}
 
-	ret := 0
-	for _, path := range paths {
+	var rewrittenPaths []string
+	deadlineReached := false
+	for i, path := range paths {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			deadlineReached = true
+			run.notStarted = len(paths) - i
+			logWarning("Deadline reached; %d of %d paths were not started.", run.notStarted, len(paths))
+			break
+		}
 		if process.dryRun {
-			logVerbose("Inspecting %s...", path)
+			logVerbose(verbosityFiles, "Inspecting %s...", path)
+		} else if process.touchOnly {
+			logVerbose(verbosityFiles, "Touching %s...", path)
 		} else {
-			logVerbose("Rewriting %s...", path)
+			logVerbose(verbosityFiles, "Rewriting %s...", path)
 		}
 
+		events.fileStart(path)
+		process.progress.fileStart(path)
 		result := processPath(path, process, seenHardLinks)
+		process.progress.fileDone()
+		events.fileDone(result)
 		run.add(result)
-		if result.outcome == pathOutcomeFailed || result.outcome == pathOutcomeRejectedNonRegular {
+		histogram.add(result)
+		plan.add(result)
+		manifest.add(result)
+		if result.failed() {
+			errorLog.add(path, result.err)
+			ret = 1
+		}
+		if result.failed() && cli.onError == onErrorAbort {
+			run.notStarted = len(paths) - i - 1
+			logWarning("Stopping after %s failed (--on-error=abort); %d of %d paths were not started.", path, run.notStarted, len(paths))
+			break
+		}
+		if result.failed() && cli.maxErrors > 0 && run.failures >= cli.maxErrors {
+			run.notStarted = len(paths) - i - 1
+			logWarning("Stopping after %d failed paths (--max-errors); %d paths were processed without failing and %d of %d were not started.", run.failures, run.paths-run.failures, run.notStarted, len(paths))
+			break
+		}
+		if cli.verifyPass && (result.outcome == pathOutcomeRewritten || result.outcome == pathOutcomeRewrittenTimesNotRestored) {
+			rewrittenPaths = append(rewrittenPaths, path)
+		}
+	}
+	stopReporting()
+
+	for _, path := range rewrittenPaths {
+		if err := verifyReadable(path, bufferSizeBytes, cli.followSymlinks || cli.followFinal); err != nil {
+			errorLog.add(path, err)
+			run.verifyFailures++
 			ret = 1
 		}
 	}
+	events.batchDone(run)
 
-	if cli.stats {
-		logInfo("%s", run.summaryLine())
+	// When filters or globbing left nothing to process, say so even without
+	// --stats so an empty selection is not mistaken for a silent success.
+	emptySelection := !deadlineReached && run.paths == run.skippedFiltered
+	if emptySelection {
+		logSkip("0 files processed: %d of %d paths were filtered out.", run.skippedFiltered, run.paths)
+	}
+	if cli.stats || emptySelection {
+		summaryColor := ansiGreen
+		if run.failures > 0 {
+			summaryColor = ansiRed
+		}
+		writeColorLine(infoOutput, summaryColor, "%s", run.summaryLine())
+	}
+	// Mismatches are listed even without --stats, since they mean the data
+	// changed after the manifest was made.
+	if run.manifestMismatch > 0 {
+		logWarning("%d files did not match %s:", run.manifestMismatch, cli.compareManifest)
+		for _, path := range run.mismatchedPaths {
+			logWarning("  %s", path)
+		}
+	}
+	if histogram != nil {
+		for _, line := range histogram.lines() {
+			logInfo("%s", line)
+		}
 	}
 
+	if ret == 0 && run.manifestMismatch > 0 {
+		ret = exitManifestMismatch
+	}
+	// A failure is reported as status 1 even when the deadline also
+	// stopped the run, so that scripts do not miss it.
+	if deadlineReached {
+		if ret == 0 {
+			ret = exitDeadlineReached
+		}
+	} else if ret == 0 && run.rewritten+run.wouldRewrite+run.touched == 0 {
+		ret = exitNothingRewritten
+	}
+	plan.finish(run, time.Since(runStart), ret)
 	return ret
 }
 
+// verifyReadable reads path from start to end for --verify-pass. The
+// returned error matches errVerify. O_NOATIME is used where permitted so the
+// pass does not disturb the access times restored by the rewrite.
+func verifyReadable(path string, bufferSizeBytes int, followSymlinks bool) error {
+	openFlags := syscall.O_RDONLY | syscall.O_NOFOLLOW
+	if followSymlinks {
+		openFlags = syscall.O_RDONLY
+	}
+	fd, err := openFile(path, openFlags|openNoAtime, 0)
+	if openNoAtime != 0 && errors.Is(err, syscall.EPERM) {
+		fd, err = openFile(path, openFlags, 0)
+	}
+	if err != nil {
+		logWarningWithError(err, "Verify pass could not open %s", path)
+		return &rewriteError{kind: errVerify, err: err}
+	}
+	defer func() {
+		_ = closeFile(fd)
+	}()
+	// The pass runs right after the rewrite, so without this most of the
+	// file would be read back from memory.
+	if err := evictCachedPages(fd, 0, 0); err != nil {
+		logWarningWithError(err, "Verify pass could not flush %s", path)
+		return &rewriteError{kind: errVerify, err: err}
+	}
+
+	buf := make([]byte, bufferSizeBytes)
+	var offset int64
+	for {
+		n, err := preadFile(fd, buf, offset)
+		if err != nil {
+			logWarningWithError(err, "Verify pass read from %s at offset %d failed", path, offset)
+			return &rewriteError{kind: errVerify, err: err}
+		}
+		if n == 0 {
+			break
+		}
+		offset += int64(n)
+	}
+	logVerbose(verbosityFiles, "Verify pass read %d bytes of %s.", offset, path)
+	return nil
+}
+
+// parseTimeValue parses a timestamp flag given as "now", an RFC 3339 time, or
+// whole seconds since the Unix epoch.
+func parseTimeValue(value string) (time.Time, error) {
+	if value == "now" {
+		return time.Now(), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, errors.New("must be \"now\", an RFC 3339 timestamp, or seconds since the Unix epoch")
+	}
+	return t, nil
+}
+
+// untilDeadline returns the next occurrence of the local time of day clock,
+// given as HH:MM, after now.
+func untilDeadline(now time.Time, clock string) (time.Time, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time of day %q: must be HH:MM", clock)
+	}
+	deadline := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !deadline.After(now) {
+		deadline = deadline.AddDate(0, 0, 1)
+	}
+	return deadline, nil
+}
+
 func main() {
 	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
@@ -4,15 +4,26 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	flag "github.com/spf13/pflag"
 )
 
 func runCLI(t *testing.T, args ...string) (int, string, string) {
@@ -25,7 +36,10 @@ func runCLIInDir(t *testing.T, dir string, args ...string) (int, string, string)
 
 	cmdArgs := append([]string{"-test.run=TestCLIMainHelper", "--"}, args...)
 	cmd := exec.Command(os.Args[0], cmdArgs...)
-	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	// Point the user config directory at an empty location so a developer's
+	// own config file cannot change test results.
+	configHome := t.TempDir()
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "HOME="+configHome, "XDG_CONFIG_HOME="+configHome)
 	if dir != "" {
 		cmd.Dir = dir
 	}
@@ -117,6 +131,11 @@ func TestIsSparseFile(t *testing.T) {
 	if isSparseFile(&dense) {
 		t.Fatal("isSparseFile returned true for densely allocated stat")
 	}
+
+	device := syscall.Stat_t{Mode: syscall.S_IFBLK | 0o660, Size: 1 << 30}
+	if isSparseFile(&device) {
+		t.Fatal("isSparseFile returned true for a block device")
+	}
 }
 
 func TestRewriteFilePreservesDataAndTimestamps(t *testing.T) {
@@ -136,8 +155,8 @@ func TestRewriteFilePreservesDataAndTimestamps(t *testing.T) {
 
 	expectedAtime, expectedMtime := fileTimes(t, path)
 
-	if ok := rewriteFile(path, 7); !ok {
-		t.Fatalf("rewriteFile returned false")
+	if err := rewriteFile(path, 7); err != nil {
+		t.Fatalf("rewriteFile returned error: %v", err)
 	}
 
 	gotAtime, gotMtime := fileTimes(t, path)
@@ -157,6 +176,44 @@ func TestRewriteFilePreservesDataAndTimestamps(t *testing.T) {
 	}
 }
 
+func TestRewriteFileSkipsAtimeOnNoAtimeMount(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte("noatime-test-data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	mtimeSet := time.Unix(1700000200, 987654321)
+	if err := os.Chtimes(path, time.Unix(1700000000, 0), mtimeSet); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	originalAtime, expectedMtime := fileTimes(t, path)
+
+	// Give the file an access time of its own just before the restore, as
+	// the mount would have left it, so a restore of the saved atime shows.
+	mountAtime := time.Unix(1700000100, 123456789)
+	savedNoAtime := noAtimeMount
+	noAtimeMount = func(fd int) bool {
+		if err := os.Chtimes(path, mountAtime, time.Time{}); err != nil {
+			t.Errorf("chtimes: %v", err)
+		}
+		return true
+	}
+	t.Cleanup(func() { noAtimeMount = savedNoAtime })
+
+	if err := rewriteFile(path, 4); err != nil {
+		t.Fatalf("rewriteFile returned error: %v", err)
+	}
+
+	gotAtime, gotMtime := fileTimes(t, path)
+	if syscall.TimespecToNsec(gotMtime) != syscall.TimespecToNsec(expectedMtime) {
+		t.Fatalf("mtime changed: got=%d want=%d", syscall.TimespecToNsec(gotMtime), syscall.TimespecToNsec(expectedMtime))
+	}
+	if syscall.TimespecToNsec(gotAtime) != mountAtime.UnixNano() {
+		t.Fatalf("atime changed by the restore: got=%d want=%d (saved atime was %d)", syscall.TimespecToNsec(gotAtime), mountAtime.UnixNano(), syscall.TimespecToNsec(originalAtime))
+	}
+}
+
 func TestRewriteFileCompletesShortWrites(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "data.bin")
@@ -177,8 +234,8 @@ func TestRewriteFileCompletesShortWrites(t *testing.T) {
 		pwriteFile = originalPwrite
 	})
 
-	if ok := rewriteFile(path, 11); !ok {
-		t.Fatalf("rewriteFile returned false")
+	if err := rewriteFile(path, 11); err != nil {
+		t.Fatalf("rewriteFile returned error: %v", err)
 	}
 
 	got, err := os.ReadFile(path)
@@ -190,6 +247,137 @@ func TestRewriteFileCompletesShortWrites(t *testing.T) {
 	}
 }
 
+func TestRewriteProgressFuncReportsEachWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	original := bytes.Repeat([]byte("p"), 100)
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var done []int64
+	options := processOptions{
+		bufferSizeBytes: 32,
+		progressFunc: func(gotPath string, gotDone, gotTotal int64) {
+			if gotPath != path {
+				t.Fatalf("progress path = %q, want %q", gotPath, path)
+			}
+			if gotTotal != int64(len(original)) {
+				t.Fatalf("progress total = %d, want %d", gotTotal, len(original))
+			}
+			done = append(done, gotDone)
+		},
+	}
+
+	if result := processPath(path, options, nil); result.err != nil {
+		t.Fatalf("processPath returned error: %v", result.err)
+	}
+	want := []int64{32, 64, 96, 100}
+	if fmt.Sprint(done) != fmt.Sprint(want) {
+		t.Fatalf("progress calls = %v, want %v", done, want)
+	}
+}
+
+func TestRewriteShouldRewriteSkipsFilteredFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte("filtered"), 0o640); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	mtimeSet := time.Unix(1700005000, 0)
+	if err := os.Chtimes(path, mtimeSet, mtimeSet); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalInfoOutput := infoOutput
+	infoOutput = &stderr
+	t.Cleanup(func() {
+		infoOutput = originalInfoOutput
+	})
+
+	writes := 0
+	savedPwrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		writes++
+		return savedPwrite(fd, buf, offset)
+	}
+	t.Cleanup(func() { pwriteFile = savedPwrite })
+
+	var seen os.FileInfo
+	options := processOptions{
+		bufferSizeBytes: 1024,
+		shouldRewrite: func(gotPath string, info os.FileInfo) bool {
+			seen = info
+			return false
+		},
+	}
+
+	result := processPath(path, options, nil)
+	if result.outcome != pathOutcomeSkippedFiltered || result.err != nil {
+		t.Fatalf("result = %+v, want filtered skip without error", result)
+	}
+	if writes != 0 {
+		t.Fatalf("pwrite calls = %d, want 0", writes)
+	}
+	if seen.Name() != "data.bin" || seen.Size() != 8 || seen.Mode() != 0o640 || !seen.ModTime().Equal(mtimeSet) {
+		t.Fatalf("file info = name %q size %d mode %v mtime %v", seen.Name(), seen.Size(), seen.Mode(), seen.ModTime())
+	}
+	if stderr.String() != "SKIP FILTERED "+path+"\n" {
+		t.Fatalf("stderr = %q, want filtered skip line", stderr.String())
+	}
+
+	options.dryRun = true
+	stderr.Reset()
+	if result := processPath(path, options, nil); result.outcome != pathOutcomeSkippedFiltered {
+		t.Fatalf("dry-run outcome = %v, want filtered skip", result.outcome)
+	}
+	if stderr.String() != "WOULD SKIP FILTERED "+path+"\n" {
+		t.Fatalf("stderr = %q, want dry-run filtered skip line", stderr.String())
+	}
+
+	var stats runStats
+	stats.add(result)
+	if !strings.Contains(stats.summaryLine(), " skipped_filtered=1 ") {
+		t.Fatalf("summary = %q, want skipped_filtered=1", stats.summaryLine())
+	}
+}
+
+func TestRewriteFileRetriesZeroWriteAfterShortWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	original := bytes.Repeat([]byte("short-then-zero-"), 16)
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	writeCount := 0
+	savedPwrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		writeCount++
+		switch writeCount {
+		case 1:
+			return savedPwrite(fd, buf[:5], offset)
+		case 2:
+			return 0, nil
+		}
+		return savedPwrite(fd, buf, offset)
+	}
+	t.Cleanup(func() { pwriteFile = savedPwrite })
+
+	if err := rewriteFile(path, 64); err != nil {
+		t.Fatalf("rewriteFile returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Fatalf("file content changed after short and zero-length writes")
+	}
+}
+
 func TestRewriteFileEmptyFile(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "empty.bin")
@@ -197,8 +385,27 @@ func TestRewriteFileEmptyFile(t *testing.T) {
 		t.Fatalf("write file: %v", err)
 	}
 
-	if ok := rewriteFile(path, 1024); !ok {
-		t.Fatalf("rewriteFile(empty) returned false")
+	ioCalls := 0
+	savedPread := preadFile
+	savedPwrite := pwriteFile
+	preadFile = func(fd int, buf []byte, offset int64) (int, error) {
+		ioCalls++
+		return savedPread(fd, buf, offset)
+	}
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		ioCalls++
+		return savedPwrite(fd, buf, offset)
+	}
+	t.Cleanup(func() {
+		preadFile = savedPread
+		pwriteFile = savedPwrite
+	})
+
+	if err := rewriteFile(path, 1024); err != nil {
+		t.Fatalf("rewriteFile(empty) returned error: %v", err)
+	}
+	if ioCalls != 0 {
+		t.Fatalf("read/write calls = %d, want 0 for empty file", ioCalls)
 	}
 
 	got, err := os.ReadFile(path)
@@ -210,6 +417,41 @@ func TestRewriteFileEmptyFile(t *testing.T) {
 	}
 }
 
+func TestProcessPathEmptyFileKeepsTimestamps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.bin")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	atime := time.Date(2019, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	mtime := time.Date(2018, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	if err := os.Chtimes(path, atime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	wantAtime, wantMtime := fileTimes(t, path)
+
+	result := processPath(path, processOptions{bufferSizeBytes: 1024}, nil)
+	if result.outcome != pathOutcomeRewritten || result.err != nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	gotAtime, gotMtime := fileTimes(t, path)
+	if syscall.TimespecToNsec(gotAtime) != syscall.TimespecToNsec(wantAtime) || syscall.TimespecToNsec(gotMtime) != syscall.TimespecToNsec(wantMtime) {
+		t.Fatalf("timestamps changed: atime=%d mtime=%d, want atime=%d mtime=%d", syscall.TimespecToNsec(gotAtime), syscall.TimespecToNsec(gotMtime), syscall.TimespecToNsec(wantAtime), syscall.TimespecToNsec(wantMtime))
+	}
+
+	setMtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	result = processPath(path, processOptions{bufferSizeBytes: 1024, setMtime: setMtime}, nil)
+	if result.outcome != pathOutcomeRewritten || result.err != nil {
+		t.Fatalf("unexpected result with --set-mtime: %+v", result)
+	}
+	gotAtime, gotMtime = fileTimes(t, path)
+	if syscall.TimespecToNsec(gotMtime) != setMtime.UnixNano() {
+		t.Fatalf("mtime = %d, want %d", syscall.TimespecToNsec(gotMtime), setMtime.UnixNano())
+	}
+	if syscall.TimespecToNsec(gotAtime) != syscall.TimespecToNsec(wantAtime) {
+		t.Fatalf("atime changed with --set-mtime: got=%d want=%d", syscall.TimespecToNsec(gotAtime), syscall.TimespecToNsec(wantAtime))
+	}
+}
+
 func TestRewriteFileExactBufferBoundary(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "boundary.bin")
@@ -220,8 +462,8 @@ func TestRewriteFileExactBufferBoundary(t *testing.T) {
 		t.Fatalf("write file: %v", err)
 	}
 
-	if ok := rewriteFile(path, bufSize); !ok {
-		t.Fatalf("rewriteFile returned false")
+	if err := rewriteFile(path, bufSize); err != nil {
+		t.Fatalf("rewriteFile returned error: %v", err)
 	}
 
 	got, err := os.ReadFile(path)
@@ -235,8 +477,8 @@ func TestRewriteFileExactBufferBoundary(t *testing.T) {
 
 func TestRewriteFileRejectsDirectory(t *testing.T) {
 	dir := t.TempDir()
-	if ok := rewriteFile(dir, 1024); ok {
-		t.Fatalf("rewriteFile(directory) = true, want false")
+	if err := rewriteFile(dir, 1024); !errors.Is(err, errNotRegular) {
+		t.Fatalf("rewriteFile(directory) error = %v, want errNotRegular", err)
 	}
 }
 
@@ -251,15 +493,17 @@ func TestRewriteFileRejectsSymlink(t *testing.T) {
 		t.Fatalf("create symlink: %v", err)
 	}
 
-	if ok := rewriteFile(link, 1024); ok {
-		t.Fatalf("rewriteFile(symlink) = true, want false")
+	if err := rewriteFile(link, 1024); !errors.Is(err, errNotRegular) {
+		t.Fatalf("rewriteFile(symlink) error = %v, want errNotRegular", err)
 	}
 }
 
 func TestRewriteFileMissingFile(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "missing.txt")
-	if ok := rewriteFile(path, 1024); ok {
-		t.Fatalf("rewriteFile(missing file) = true, want false")
+	if err := rewriteFile(path, 1024); !errors.Is(err, errStat) {
+		t.Fatalf("rewriteFile(missing file) error = %v, want errStat", err)
+	} else if !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("rewriteFile(missing file) error = %v, want wrapped ENOENT", err)
 	}
 }
 
@@ -281,8 +525,8 @@ func TestRewriteFileRejectsPathSwapBetweenInspectAndOpen(t *testing.T) {
 	}
 	t.Cleanup(func() { lstatFile = savedLstat })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on path identity mismatch")
+	if err := rewriteFile(path, 64); !errors.Is(err, errIdentityChanged) {
+		t.Fatalf("rewriteFile should have failed on path identity mismatch: got %v, want errIdentityChanged", err)
 	}
 
 	got, err := os.ReadFile(path)
@@ -313,8 +557,8 @@ func TestRewriteFileFailsOnDataSyncError(t *testing.T) {
 	}
 	t.Cleanup(func() { syncFile = savedSync })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on data sync error")
+	if err := rewriteFile(path, 64); !errors.Is(err, errSync) {
+		t.Fatalf("rewriteFile should have failed on data sync error: got %v, want errSync", err)
 	}
 	if syncCalls != 1 {
 		t.Fatalf("sync calls = %d, want 1", syncCalls)
@@ -355,8 +599,8 @@ func TestRewriteFileFailsOnTimestampSyncError(t *testing.T) {
 	}
 	t.Cleanup(func() { syncFile = savedSync })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on timestamp sync error")
+	if err := rewriteFile(path, 64); !errors.Is(err, errSync) {
+		t.Fatalf("rewriteFile should have failed on timestamp sync error: got %v, want errSync", err)
 	}
 	if syncCalls != 2 {
 		t.Fatalf("sync calls = %d, want 2", syncCalls)
@@ -398,8 +642,8 @@ func TestRewriteFileFailsOnCloseError(t *testing.T) {
 	}
 	t.Cleanup(func() { closeFile = savedClose })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on close error")
+	if err := rewriteFile(path, 64); !errors.Is(err, errClose) {
+		t.Fatalf("rewriteFile should have failed on close error: got %v, want errClose", err)
 	}
 	if closeCalls != 1 {
 		t.Fatalf("close calls = %d, want 1", closeCalls)
@@ -448,8 +692,8 @@ func TestRewritePreservesContentAcrossSizes(t *testing.T) {
 				t.Fatalf("write file: %v", err)
 			}
 
-			if ok := rewriteFile(path, tc.buf); !ok {
-				t.Fatalf("rewriteFile returned false")
+			if err := rewriteFile(path, tc.buf); err != nil {
+				t.Fatalf("rewriteFile returned error: %v", err)
 			}
 
 			got, err := os.ReadFile(path)
@@ -486,8 +730,8 @@ func TestRewriteContentUnchangedOnReadError(t *testing.T) {
 	}
 	t.Cleanup(func() { preadFile = savedPread })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on injected read error")
+	if err := rewriteFile(path, 64); !errors.Is(err, errRead) {
+		t.Fatalf("rewriteFile should have failed on injected read error: got %v, want errRead", err)
 	}
 
 	got, err := os.ReadFile(path)
@@ -522,8 +766,8 @@ func TestRewriteContentUnchangedOnWriteError(t *testing.T) {
 	}
 	t.Cleanup(func() { pwriteFile = savedPwrite })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on injected write error")
+	if err := rewriteFile(path, 64); !errors.Is(err, errWrite) {
+		t.Fatalf("rewriteFile should have failed on injected write error: got %v, want errWrite", err)
 	}
 
 	got, err := os.ReadFile(path)
@@ -535,9 +779,9 @@ func TestRewriteContentUnchangedOnWriteError(t *testing.T) {
 	}
 }
 
-// TestRewriteContentUnchangedOnZeroWrite verifies that if pwrite returns
-// (0, nil) — no progress — the rewrite bails out rather than looping
-// forever, and the file content is unchanged.
+// TestRewriteContentUnchangedOnZeroWrite verifies that if pwrite keeps
+// returning (0, nil) — no progress — the rewrite bails out after the retry
+// budget rather than looping forever, and the file content is unchanged.
 func TestRewriteContentUnchangedOnZeroWrite(t *testing.T) {
 	dir := t.TempDir()
 	path := filepath.Join(dir, "data.bin")
@@ -551,15 +795,18 @@ func TestRewriteContentUnchangedOnZeroWrite(t *testing.T) {
 	savedPwrite := pwriteFile
 	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
 		writeCount++
-		if writeCount == 2 {
+		if writeCount >= 2 {
 			return 0, nil
 		}
 		return savedPwrite(fd, buf, offset)
 	}
 	t.Cleanup(func() { pwriteFile = savedPwrite })
 
-	if ok := rewriteFile(path, 64); ok {
-		t.Fatalf("rewriteFile should have failed on zero-length write")
+	if err := rewriteFile(path, 64); !errors.Is(err, errWrite) {
+		t.Fatalf("rewriteFile should have failed on zero-length write: got %v, want errWrite", err)
+	}
+	if want := 2 + maxZeroWriteRetries; writeCount != want {
+		t.Fatalf("pwrite calls = %d, want %d", writeCount, want)
 	}
 
 	got, err := os.ReadFile(path)
@@ -594,9 +841,15 @@ func TestCLIHelpShortFlag(t *testing.T) {
 	if !strings.Contains(stderr, "--skip-sparse") {
 		t.Fatalf("help output missing skip-sparse flag: %q", stderr)
 	}
+	if !strings.Contains(stderr, "--follow-symlinks") {
+		t.Fatalf("help output missing follow-symlinks flag: %q", stderr)
+	}
 	if !strings.Contains(stderr, "--stats") {
 		t.Fatalf("help output missing stats flag: %q", stderr)
 	}
+	if !strings.Contains(stderr, "--color string") {
+		t.Fatalf("help output missing color flag: %q", stderr)
+	}
 	if !strings.Contains(stderr, "--version") {
 		t.Fatalf("help output missing version flag: %q", stderr)
 	}
@@ -627,14 +880,39 @@ func TestCLIVersionFlag(t *testing.T) {
 	if exitCode != 0 {
 		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
 	}
-	if stdout != appVersion+"\n" {
-		t.Fatalf("stdout = %q, want %q", stdout, appVersion+"\\n")
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 3 || lines[0] != appVersion {
+		t.Fatalf("stdout = %q, want version followed by commit and Go version", stdout)
+	}
+	if !strings.HasPrefix(lines[1], "commit: ") {
+		t.Fatalf("stdout missing commit line: %q", stdout)
+	}
+	if lines[2] != "go: "+runtime.Version() {
+		t.Fatalf("stdout Go version line = %q, want %q", lines[2], "go: "+runtime.Version())
 	}
 	if stderr != "" {
 		t.Fatalf("stderr = %q, want empty", stderr)
 	}
 }
 
+func TestVersionTextIncludesVCSRevision(t *testing.T) {
+	original := readBuildInfo
+	readBuildInfo = func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123456789abcdef"},
+			{Key: "vcs.modified", Value: "true"},
+		}}, true
+	}
+	t.Cleanup(func() {
+		readBuildInfo = original
+	})
+
+	want := appVersion + "\ncommit: 0123456789abcdef-dirty\ngo: " + runtime.Version()
+	if got := versionText(); got != want {
+		t.Fatalf("versionText() = %q, want %q", got, want)
+	}
+}
+
 func TestCLIVerboseShortFlag(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "data.txt")
 	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
@@ -665,6 +943,68 @@ func TestCLIVerboseLongFlag(t *testing.T) {
 	}
 }
 
+func TestCLIVerbosityLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	tests := []struct {
+		args        []string
+		wantChunks  bool
+		wantSyscall bool
+	}{
+		{args: []string{"-v"}},
+		{args: []string{"-vv"}, wantChunks: true},
+		{args: []string{"-v", "-v", "-v"}, wantChunks: true, wantSyscall: true},
+		{args: []string{"--verbose=3"}, wantChunks: true, wantSyscall: true},
+	}
+
+	for _, tt := range tests {
+		exitCode, _, stderr := runCLI(t, append(tt.args, path)...)
+		if exitCode != 0 {
+			t.Fatalf("%v: exit code = %d, want 0; stderr=%q", tt.args, exitCode, stderr)
+		}
+		if !strings.Contains(stderr, "Rewriting "+path+"...") {
+			t.Fatalf("%v: verbose output missing rewrite line: %q", tt.args, stderr)
+		}
+		if !strings.Contains(stderr, "Rewrote "+path+": 3 B in ") {
+			t.Fatalf("%v: verbose output missing throughput line: %q", tt.args, stderr)
+		}
+		if got := strings.Contains(stderr, "Read 3 from "+path+" at offset 0."); got != tt.wantChunks {
+			t.Fatalf("%v: chunk output present = %v, want %v: %q", tt.args, got, tt.wantChunks, stderr)
+		}
+		if got := strings.Contains(stderr, "fstat "+path+":"); got != tt.wantSyscall {
+			t.Fatalf("%v: syscall output present = %v, want %v: %q", tt.args, got, tt.wantSyscall, stderr)
+		}
+		if got := strings.Contains(stderr, "(read from "+statTimeFields+", written with "+restoreTimesMethod+")."); got != tt.wantSyscall {
+			t.Fatalf("%v: timestamp mechanism output present = %v, want %v: %q", tt.args, got, tt.wantSyscall, stderr)
+		}
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	if got, want := throughput(512*bytesPerMB, 3100*time.Millisecond), "512.0 MB in 3.1s (165.2 MB/s)"; got != want {
+		t.Fatalf("throughput() = %q, want %q", got, want)
+	}
+	tests := []struct {
+		n       int64
+		elapsed time.Duration
+		want    string
+	}{
+		{0, 0, "0 B in 0.0ms (0 B/s)"},
+		{100, 2 * time.Second, "100 B in 2.0s (50 B/s)"},
+		{4096, 250 * time.Microsecond, "4.0 KB in 0.2ms (15.6 MB/s)"},
+		{3 * 1024 * bytesPerMB, 1500 * time.Millisecond, "3.0 GB in 1.5s (2.0 GB/s)"},
+		{5 << 50, time.Second, "5120.0 TB in 1.0s (5120.0 TB/s)"},
+	}
+	for _, tt := range tests {
+		if got := throughput(tt.n, tt.elapsed); got != tt.want {
+			t.Fatalf("throughput(%d, %s) = %q, want %q", tt.n, tt.elapsed, got, tt.want)
+		}
+	}
+}
+
 func TestCLIBufferSizeShortFlag(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "data.txt")
 	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 4096), 0o644); err != nil {
@@ -824,8 +1164,8 @@ func TestCLIDryRunSkipSparseReportsSparseSkip(t *testing.T) {
 	path := createSparseTestFile(t, dir, "sparse.img")
 
 	exitCode, _, stderr := runCLI(t, "--dry-run", "--skip-sparse", path)
-	if exitCode != 0 {
-		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	if exitCode != exitNothingRewritten {
+		t.Fatalf("exit code = %d, want %d; stderr=%q", exitCode, exitNothingRewritten, stderr)
 	}
 	if stderr != "WOULD SKIP SPARSE "+path+"\n" {
 		t.Fatalf("stderr = %q, want %q", stderr, "WOULD SKIP SPARSE "+path+"\\n")
@@ -864,8 +1204,8 @@ func TestCLISkipSparseStats(t *testing.T) {
 	path := createSparseTestFile(t, dir, "sparse.img")
 
 	exitCode, _, stderr := runCLI(t, "--skip-sparse", "--stats", path)
-	if exitCode != 0 {
-		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	if exitCode != exitNothingRewritten {
+		t.Fatalf("exit code = %d, want %d; stderr=%q", exitCode, exitNothingRewritten, stderr)
 	}
 	if !strings.Contains(stderr, "SKIP SPARSE "+path) {
 		t.Fatalf("sparse skip output missing: %q", stderr)
@@ -875,6 +1215,43 @@ func TestCLISkipSparseStats(t *testing.T) {
 	}
 }
 
+func TestCLIBufferSizeFromEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	t.Setenv(bufferSizeEnv, "0")
+	exitCode, _, stderr := runCLI(t, path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "invalid buffer size 0 MB") {
+		t.Fatalf("environment buffer size not applied: %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "-b", "1", path)
+	if exitCode != 0 {
+		t.Fatalf("flag should override environment; exit code = %d, stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIInvalidBufferSizeEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	t.Setenv(bufferSizeEnv, "8M")
+	exitCode, _, stderr := runCLI(t, path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, `invalid FILEREWRITE_BUFFERSIZE "8M"`) {
+		t.Fatalf("expected invalid environment warning, got: %q", stderr)
+	}
+}
+
 func TestCLIOversizedBufferSize(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "data.txt")
 	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
@@ -954,6 +1331,25 @@ func TestCLIDedupHardlinksStats(t *testing.T) {
 	}
 }
 
+func TestCLIDedupHardlinksCatchesDifferentlySpelledPaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	// Stands in for case variants on a case-insensitive filesystem: the
+	// strings differ but name the same inode.
+	variant := dir + "/./data.txt"
+
+	exitCode, _, stderr := runCLI(t, "--dedup-hardlinks", "--stats", path, variant)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, " rewritten=1 ") || !strings.Contains(stderr, " skipped_hardlinks=1 ") {
+		t.Fatalf("stats summary missing or incorrect: %q", stderr)
+	}
+}
+
 func TestCLIMixedResultsExitOne(t *testing.T) {
 	dir := t.TempDir()
 	validPath := filepath.Join(dir, "data.txt")
@@ -996,3 +1392,3285 @@ func TestCLIStatsMixedResults(t *testing.T) {
 		t.Fatalf("stats summary missing or incorrect: %q", stderr)
 	}
 }
+
+func TestCLIColorAlwaysColorizesWarningsAndSummary(t *testing.T) {
+	dir := t.TempDir()
+	validPath := filepath.Join(dir, "data.txt")
+	missingPath := filepath.Join(dir, "missing.txt")
+	if err := os.WriteFile(validPath, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--color=always", "--stats", validPath)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.HasPrefix(stderr, ansiGreen+"Summary: ") || !strings.HasSuffix(stderr, ansiReset+"\n") {
+		t.Fatalf("summary not colorized green: %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--color=always", "--stats", missingPath)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, ansiRed+"Unable to stat "+missingPath) {
+		t.Fatalf("warning not colorized red: %q", stderr)
+	}
+	if !strings.Contains(stderr, ansiRed+"Summary: ") {
+		t.Fatalf("failing summary not colorized red: %q", stderr)
+	}
+}
+
+func TestCLIColorAutoDisabledWithoutTTY(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--stats", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if strings.Contains(stderr, "\x1b[") {
+		t.Fatalf("auto color should be disabled without a TTY: %q", stderr)
+	}
+}
+
+func TestResolveColorNoColorDisablesAuto(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	if got, err := resolveColor(colorAuto, os.Stderr); err != nil || got {
+		t.Fatalf("resolveColor(auto) = %v, %v; want false, nil", got, err)
+	}
+	if got, err := resolveColor(colorAlways, os.Stderr); err != nil || !got {
+		t.Fatalf("resolveColor(always) = %v, %v; want true, nil", got, err)
+	}
+}
+
+func TestCLIInvalidColorMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--color=sometimes", path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, `invalid color mode "sometimes"`) {
+		t.Fatalf("expected invalid color mode warning, got: %q", stderr)
+	}
+}
+
+func TestCLIFollowSymlinksRewritesTargetOnce(t *testing.T) {
+	dir := t.TempDir()
+	targetPath := filepath.Join(dir, "data.txt")
+	firstLink := filepath.Join(dir, "first.txt")
+	secondLink := filepath.Join(dir, "second.txt")
+	original := []byte("abc")
+	if err := os.WriteFile(targetPath, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.Symlink(targetPath, firstLink); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+	if err := os.Symlink(targetPath, secondLink); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--follow-symlinks", "--stats", firstLink, secondLink, targetPath)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Summary: paths=3 rewritten=1 would_rewrite=0 skipped_non_regular=0 skipped_hardlinks=2 skipped_sparse=0 failures=0 bytes_rewritten=3") {
+		t.Fatalf("stats summary missing or incorrect: %q", stderr)
+	}
+
+	got, err := os.ReadFile(targetPath)
+	if err != nil {
+		t.Fatalf("read target file: %v", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Fatalf("target file data changed")
+	}
+}
+
+func TestCLIFollowSymlinksReportsLoop(t *testing.T) {
+	dir := t.TempDir()
+	loopA := filepath.Join(dir, "a")
+	loopB := filepath.Join(dir, "b")
+	if err := os.Symlink(loopB, loopA); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+	if err := os.Symlink(loopA, loopB); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--follow-symlinks", loopA)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Unable to stat "+loopA) {
+		t.Fatalf("symlink loop not reported: %q", stderr)
+	}
+}
+
+func TestCLIFollowFinalRejectsSymlinkedDirectories(t *testing.T) {
+	if !followFinalSupported {
+		t.Skip("--follow-final is not supported on this platform")
+	}
+	root := t.TempDir()
+	dir := filepath.Join(root, "dir")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	target := filepath.Join(dir, "target.txt")
+	if err := os.WriteFile(target, []byte("follow final"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Symlink("target.txt", link); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+	linkedDir := filepath.Join(root, "linked")
+	if err := os.Symlink(dir, linkedDir); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--follow-final", "--stats", link)
+	if exitCode != 0 || !strings.Contains(stderr, " rewritten=1 ") {
+		t.Fatalf("final symlink: exit=%d stderr=%q", exitCode, stderr)
+	}
+	exitCode, _, stderr = runCLIInDir(t, root, "--follow-final", "dir/link.txt")
+	if exitCode != 0 {
+		t.Fatalf("relative final symlink: exit=%d stderr=%q", exitCode, stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--follow-final", filepath.Join(linkedDir, "target.txt"))
+	if exitCode != 1 || !strings.Contains(stderr, "directory "+linkedDir+"/ is a symlink") {
+		t.Fatalf("symlinked directory: exit=%d stderr=%q", exitCode, stderr)
+	}
+
+	for _, args := range [][]string{{"--follow-final", "--follow-symlinks"}, {"--follow-final", "--abspath"}} {
+		if exitCode, _, _ := runCLI(t, append(args, link)...); exitCode != 2 {
+			t.Fatalf("%v exit code = %d, want 2", args, exitCode)
+		}
+	}
+}
+
+func TestCLILowerPriority(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--nice", "19", "--ionice", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIInvalidNiceValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	for _, value := range []string{"20", "-1", "-20"} {
+		exitCode, _, stderr := runCLI(t, "--nice", value, path)
+		if exitCode != 2 {
+			t.Fatalf("--nice %s: exit code = %d, want 2; stderr=%q", value, exitCode, stderr)
+		}
+		if !strings.Contains(stderr, "invalid nice value "+value+": must be between 0 and 19") {
+			t.Fatalf("--nice %s: expected invalid nice warning, got: %q", value, stderr)
+		}
+	}
+}
+
+func TestRespectLocksSkipsLockedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	original := []byte("locked")
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	originalInfoOutput := infoOutput
+	errorOutput = &stderr
+	infoOutput = io.Discard
+	writes := 0
+	savedPwrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		writes++
+		return savedPwrite(fd, buf, offset)
+	}
+	originalFindFileLock := findFileLock
+	findFileLock = func(sb *syscall.Stat_t) (string, bool, error) {
+		return "POSIX ADVISORY WRITE lock held by pid 1234", true, nil
+	}
+	t.Cleanup(func() {
+		errorOutput = originalErrorOutput
+		infoOutput = originalInfoOutput
+		pwriteFile = savedPwrite
+		findFileLock = originalFindFileLock
+	})
+
+	for _, dryRun := range []bool{false, true} {
+		stderr.Reset()
+		result := processPath(path, processOptions{bufferSizeBytes: 64, respectLocks: true, dryRun: dryRun}, nil)
+		if result.outcome != pathOutcomeSkippedLocked || result.err != nil {
+			t.Fatalf("dry-run=%v: result = %+v, want locked skip", dryRun, result)
+		}
+		want := "SKIP LOCKED " + path + ": POSIX ADVISORY WRITE lock held by pid 1234\n"
+		if dryRun {
+			want = "WOULD " + want
+		}
+		if stderr.String() != want {
+			t.Fatalf("dry-run=%v: stderr = %q, want %q", dryRun, stderr.String(), want)
+		}
+	}
+	if writes != 0 {
+		t.Fatalf("pwrite calls = %d, want 0", writes)
+	}
+
+	findFileLock = func(sb *syscall.Stat_t) (string, bool, error) {
+		return "", false, syscall.EACCES
+	}
+	if result := processPath(path, processOptions{bufferSizeBytes: 64, respectLocks: true}, nil); result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten when locks cannot be checked", result.outcome)
+	}
+
+	var stats runStats
+	stats.add(pathResult{path: path, outcome: pathOutcomeSkippedLocked})
+	if !strings.Contains(stats.summaryLine(), " skipped_locked=1 ") || stats.failures != 0 {
+		t.Fatalf("summary = %q, want skipped_locked=1 without failures", stats.summaryLine())
+	}
+}
+
+func TestWarnOnHolesLogsSparseFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("h"), 3000), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	originalInfoOutput := infoOutput
+	errorOutput = &stderr
+	infoOutput = io.Discard
+	hole := int64(1024)
+	originalFindHole := findHole
+	findHole = func(fd int) (int64, error) {
+		return hole, nil
+	}
+	t.Cleanup(func() {
+		errorOutput = originalErrorOutput
+		infoOutput = originalInfoOutput
+		findHole = originalFindHole
+	})
+
+	want := path + " is sparse (first hole at offset 1024); rewriting it will allocate its holes.\n"
+	for _, dryRun := range []bool{false, true} {
+		stderr.Reset()
+		result := processPath(path, processOptions{bufferSizeBytes: 1024, warnOnHoles: true, dryRun: dryRun}, nil)
+		if result.failed() {
+			t.Fatalf("dry-run=%v: result = %+v, want success", dryRun, result)
+		}
+		if stderr.String() != want {
+			t.Fatalf("dry-run=%v: stderr = %q, want %q", dryRun, stderr.String(), want)
+		}
+	}
+
+	hole = 3000
+	stderr.Reset()
+	if result := processPath(path, processOptions{bufferSizeBytes: 1024, warnOnHoles: true}, nil); result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten", result.outcome)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("stderr = %q, want no warning for a file whose only hole is at EOF", stderr.String())
+	}
+}
+
+func TestRewriteVerifyRelocationWarnsOnUnchangedExtents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte("relocation"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	originalMap := mapFileExtents
+	calls := 0
+	mapFileExtents = func(fd int) ([]fileExtent, error) {
+		calls++
+		return []fileExtent{{logical: 0, physical: 4096, length: 4096}}, nil
+	}
+	t.Cleanup(func() {
+		errorOutput = originalErrorOutput
+		mapFileExtents = originalMap
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 1024, verifyRelocate: true}, nil)
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten; stderr=%q", result.outcome, stderr.String())
+	}
+	if calls != 2 {
+		t.Fatalf("extent map calls = %d, want 2", calls)
+	}
+	if !strings.Contains(stderr.String(), "Rewrite of "+path+" did not relocate any blocks") {
+		t.Fatalf("missing relocation warning: %q", stderr.String())
+	}
+}
+
+func TestRewriteVerifyRelocationQuietWhenExtentsMove(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte("relocation"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	originalMap := mapFileExtents
+	physical := uint64(4096)
+	mapFileExtents = func(fd int) ([]fileExtent, error) {
+		physical += 4096
+		return []fileExtent{{logical: 0, physical: physical, length: 4096}}, nil
+	}
+	t.Cleanup(func() {
+		errorOutput = originalErrorOutput
+		mapFileExtents = originalMap
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 1024, verifyRelocate: true}, nil)
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten; stderr=%q", result.outcome, stderr.String())
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("unexpected warning output: %q", stderr.String())
+	}
+}
+
+func TestRewriteFailureReportsLocation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 3000), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	var sb syscall.Stat_t
+	if err := syscall.Stat(path, &sb); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	originalMap := mapFileExtents
+	mapFileExtents = func(fd int) ([]fileExtent, error) {
+		return []fileExtent{{logical: 0, physical: 1 << 20, length: 4096}}, nil
+	}
+	savedPwrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		if offset >= 1024 {
+			return 0, syscall.EIO
+		}
+		return savedPwrite(fd, buf, offset)
+	}
+	t.Cleanup(func() {
+		errorOutput = originalErrorOutput
+		mapFileExtents = originalMap
+		pwriteFile = savedPwrite
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 1024}, nil)
+	if result.outcome != pathOutcomeFailed || !errors.Is(result.err, errWrite) {
+		t.Fatalf("result = %+v, want write failure", result)
+	}
+	want := failureLocation{dev: uint64(sb.Dev), ino: uint64(sb.Ino), offset: 1024, physical: 1<<20 + 1024}
+	if result.location == nil || *result.location != want {
+		t.Fatalf("location = %+v, want %+v", result.location, want)
+	}
+	if line := fmt.Sprintf("%s failed at dev=%d ino=%d offset=1024 physical_offset=%d", path, sb.Dev, sb.Ino, 1<<20+1024); !strings.Contains(stderr.String(), line) {
+		t.Fatalf("stderr = %q, want %q", stderr.String(), line)
+	}
+
+	var events bytes.Buffer
+	newProgressStream(&events).fileDone(result)
+	wantEvent := fmt.Sprintf(`{"event":"file-done","path":%q,"bytes_done":0,"failed":true,"dev":%d,"ino":%d,"offset":1024,"physical_offset":%d}`+"\n", path, sb.Dev, sb.Ino, 1<<20+1024)
+	if events.String() != wantEvent {
+		t.Fatalf("event = %q, want %q", events.String(), wantEvent)
+	}
+}
+
+func TestBatchProgressLine(t *testing.T) {
+	progress := &batchProgress{totalFiles: 5}
+	progress.fileDone()
+	progress.fileDone()
+	progress.addBytes(3 * bytesPerMB)
+
+	got := progress.line(2*bytesPerMB, 2*time.Second)
+	want := "Progress: files_done=2 files_remaining=3 bytes_done=3145728 mb_per_sec=1.00"
+	if got != want {
+		t.Fatalf("line = %q, want %q", got, want)
+	}
+}
+
+func TestBatchProgressNilSafe(t *testing.T) {
+	var progress *batchProgress
+	progress.addBytes(1)
+	progress.fileDone()
+	progress.fileStart("data.bin")
+}
+
+func TestBatchProgressBarLine(t *testing.T) {
+	progress := &batchProgress{totalFiles: 10, totalBytes: 1000 * bytesPerMB}
+	if got, want := progress.barLine(time.Second), "[------------------------------]   0.0% 0.0/1000.0 MB 0/10 files ETA ?"; got != want {
+		t.Fatalf("barLine = %q, want %q", got, want)
+	}
+
+	for range 3 {
+		progress.fileDone()
+	}
+	progress.addBytes(300 * bytesPerMB)
+	progress.fileStart("data.bin")
+	got := progress.barLine(3 * time.Second)
+	want := "[#########---------------------]  30.0% 300.0/1000.0 MB 3/10 files ETA 7s data.bin"
+	if got != want {
+		t.Fatalf("barLine = %q, want %q", got, want)
+	}
+}
+
+func TestProgressBarClearedBeforeLogLines(t *testing.T) {
+	savedRedraw := progressBarRedraw
+	progressBarRedraw = time.Millisecond
+	t.Cleanup(func() { progressBarRedraw = savedRedraw })
+
+	var out bytes.Buffer
+	progress := &batchProgress{totalFiles: 1, totalBytes: bytesPerMB}
+	stop := progress.startBar(&out, true)
+	time.Sleep(20 * time.Millisecond)
+	writeLine(&out, "SKIP CLEAN data.bin")
+	stop()
+
+	got := out.String()
+	if !strings.Contains(got, "\x1b[K\r\x1b[KSKIP CLEAN data.bin\n") {
+		t.Fatalf("output = %q, want the bar cleared before the log line", got)
+	}
+	if !strings.HasSuffix(got, "files ETA ?\x1b[K\n") {
+		t.Fatalf("output = %q, want the bar drawn again and ended with a newline", got)
+	}
+}
+
+func TestCLIProgressBar(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.bin", "b.bin"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, bytes.Repeat([]byte("p"), 1000), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	exitCode, _, stderr := runCLI(t, append([]string{"--progress-bar"}, paths...)...)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	// stderr is not a terminal here, so only the final line is printed.
+	want := "[##############################] 100.0% 0.0/0.0 MB 2/2 files ETA 0s " + paths[1] + "\n"
+	if stderr != want {
+		t.Fatalf("stderr = %q, want %q", stderr, want)
+	}
+
+	_, _, stderr = runCLI(t, append([]string{"--progress-bar", "--dry-run"}, paths...)...)
+	if strings.Contains(stderr, "files ETA") {
+		t.Fatalf("--dry-run drew a progress bar: %q", stderr)
+	}
+}
+
+func TestCLIWorkPlan(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.bin")
+	large := filepath.Join(dir, "large.bin")
+	missing := filepath.Join(dir, "missing.bin")
+	for _, path := range []string{small, large} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	planPath := filepath.Join(dir, "plan.json")
+	plan, err := json.Marshal([]map[string]any{
+		{"path": large, "size": 2 * bytesPerMB},
+		{"path": missing, "size": bytesPerMB},
+		{"path": small, "size": 4},
+	})
+	if err != nil {
+		t.Fatalf("marshal plan: %v", err)
+	}
+	if err := os.WriteFile(planPath, plan, 0o644); err != nil {
+		t.Fatalf("write plan: %v", err)
+	}
+
+	exitCode, stdout, _ := runCLI(t, "--plan", planPath, "--dry-run", "--json")
+	if exitCode != 1 {
+		t.Fatalf("dry-run exit code = %d, want 1", exitCode)
+	}
+	var order []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var entry planEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		if entry.Path != "" {
+			order = append(order, entry.Path)
+		}
+	}
+	if want := []string{large, missing, small}; !slices.Equal(order, want) {
+		t.Fatalf("order = %v, want the plan order %v", order, want)
+	}
+
+	// The bar's total comes from the plan, not from the files on disk.
+	exitCode, _, stderr := runCLI(t, "--plan", planPath, "--progress-bar", "--stats")
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "/3.0 MB 3/3 files") || !strings.Contains(stderr, "Summary: paths=3 rewritten=2 ") || !strings.Contains(stderr, " failures=1 ") {
+		t.Fatalf("stderr = %q, want the plan total and the missing path as a failure", stderr)
+	}
+
+	empty := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(empty, []byte("[]"), 0o644); err != nil {
+		t.Fatalf("write plan: %v", err)
+	}
+	if exitCode, _, _ := runCLI(t, "--plan", empty); exitCode != exitNothingRewritten {
+		t.Fatalf("empty plan exit code = %d, want %d", exitCode, exitNothingRewritten)
+	}
+	malformed := filepath.Join(dir, "malformed.json")
+	if err := os.WriteFile(malformed, []byte(`[{"size": 4}]`), 0o644); err != nil {
+		t.Fatalf("write plan: %v", err)
+	}
+	for _, args := range [][]string{{"--plan", malformed}, {"--plan", planPath, small}, {"--plan", planPath, "--shuffle"}} {
+		if exitCode, _, _ := runCLI(t, args...); exitCode != 2 {
+			t.Fatalf("%v exit code = %d, want 2", args, exitCode)
+		}
+	}
+}
+
+func TestBatchProgressReportsPeriodically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalInfoOutput := infoOutput
+	infoOutput = &stderr
+	t.Cleanup(func() {
+		infoOutput = originalInfoOutput
+	})
+
+	progress := &batchProgress{totalFiles: 1}
+	stop := progress.startReporting(time.Millisecond)
+	result := processPath(path, processOptions{bufferSizeBytes: 1024, progress: progress}, nil)
+	progress.fileDone()
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten", result.outcome)
+	}
+	outputMu.Lock()
+	output := stderr.String()
+	outputMu.Unlock()
+	if !strings.Contains(output, "Progress: files_done=1 files_remaining=0 bytes_done=3 ") {
+		t.Fatalf("progress output missing: %q", output)
+	}
+}
+
+func TestCLIInvalidStatsInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--stats-interval=-1s", path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "invalid stats interval -1s") {
+		t.Fatalf("expected invalid stats interval warning, got: %q", stderr)
+	}
+}
+
+func TestCLICheckFirstReportsAllInvalidPathsWithoutRewriting(t *testing.T) {
+	dir := t.TempDir()
+	validPath := filepath.Join(dir, "data.txt")
+	missingA := filepath.Join(dir, "missing-a.txt")
+	missingB := filepath.Join(dir, "missing-b.txt")
+	if err := os.WriteFile(validPath, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--check-first", "-v", validPath, missingA, dir, missingB)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	for _, want := range []string{"Unable to stat " + missingA, "Unable to stat " + missingB, dir + " is not a regular file", "3 of 4 paths failed the preflight check"} {
+		if !strings.Contains(stderr, want) {
+			t.Fatalf("preflight output missing %q: %q", want, stderr)
+		}
+	}
+	if strings.Contains(stderr, "Rewriting ") {
+		t.Fatalf("no path should be rewritten after a failed preflight: %q", stderr)
+	}
+}
+
+func TestCLICheckFirstKeepGoingRewritesValidPaths(t *testing.T) {
+	dir := t.TempDir()
+	validPath := filepath.Join(dir, "data.txt")
+	missingPath := filepath.Join(dir, "missing.txt")
+	if err := os.WriteFile(validPath, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--check-first", "--keep-going", "--stats", missingPath, validPath)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if strings.Count(stderr, "Unable to stat "+missingPath) != 1 {
+		t.Fatalf("missing path should be reported once: %q", stderr)
+	}
+	if !strings.Contains(stderr, "Summary: paths=2 rewritten=1 would_rewrite=0 skipped_non_regular=0 skipped_hardlinks=0 skipped_sparse=0 failures=1 bytes_rewritten=3") {
+		t.Fatalf("stats summary missing or incorrect: %q", stderr)
+	}
+}
+
+func TestCLICheckFirstOnErrorSkipSkipsNonRegularPaths(t *testing.T) {
+	dir := t.TempDir()
+	validPath := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(validPath, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	subdir := filepath.Join(dir, "subdir")
+	if err := os.Mkdir(subdir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--check-first", "--on-error=skip", "--stats", fifo, validPath, subdir)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	for _, path := range []string{fifo, subdir} {
+		if strings.Count(stderr, "SKIP NON-REGULAR "+path+"\n") != 1 {
+			t.Fatalf("%s should be skipped once: %q", path, stderr)
+		}
+	}
+	if strings.Contains(stderr, "preflight check") || !strings.Contains(stderr, "Summary: paths=3 rewritten=1 would_rewrite=0 skipped_non_regular=2 ") || !strings.Contains(stderr, " failures=0 ") {
+		t.Fatalf("unexpected stderr: %q", stderr)
+	}
+
+	missingPath := filepath.Join(dir, "missing.txt")
+	exitCode, _, stderr = runCLI(t, "--check-first", "--on-error=skip", fifo, missingPath, validPath)
+	if exitCode != 2 || !strings.Contains(stderr, "1 of 3 paths failed the preflight check") {
+		t.Fatalf("missing path: exit=%d stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIAllowDevices(t *testing.T) {
+	const devicePath = "/dev/null"
+	if _, err := os.Stat(devicePath); err != nil {
+		t.Skipf("%s unavailable: %v", devicePath, err)
+	}
+
+	exitCode, _, stderr := runCLI(t, devicePath)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, devicePath+" is not a regular file, skipping.") {
+		t.Fatalf("device should be rejected without --allow-devices: %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--allow-devices", "--dry-run", devicePath)
+	// /dev/null is a character device, which Linux does not use for disks.
+	if runtime.GOOS == "linux" {
+		if exitCode != 1 || !strings.Contains(stderr, devicePath+" is a character device, which cannot be rewritten on Linux") {
+			t.Fatalf("exit code = %d, stderr = %q; want the character device rejected", exitCode, stderr)
+		}
+		return
+	}
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if stderr != "WOULD REWRITE "+devicePath+"\n" {
+		t.Fatalf("stderr = %q, want dry-run rewrite line", stderr)
+	}
+}
+
+func TestRewriteDeviceWithoutSizeFails(t *testing.T) {
+	const devicePath = "/dev/null"
+	if _, err := os.Stat(devicePath); err != nil {
+		t.Skipf("%s unavailable: %v", devicePath, err)
+	}
+
+	want := errDeviceSize
+	if runtime.GOOS == "linux" {
+		want = errNotRegular
+	}
+	result := processPath(devicePath, processOptions{bufferSizeBytes: 1024, allowDevices: true}, nil)
+	if !errors.Is(result.err, want) {
+		t.Fatalf("processPath(%s) error = %v, want %v", devicePath, result.err, want)
+	}
+}
+
+func TestRewriteOpenFileStopsAtDeviceSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device.img")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("d"), 100), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open file: %v", err)
+	}
+	defer f.Close()
+
+	sb := syscall.Stat_t{Size: 10}
+	sb.Mode = syscall.S_IFBLK | 0o600
+	result := rewriteOpenFile(int(f.Fd()), path, processOptions{bufferSizeBytes: 4}, &sb)
+	if result.err != nil {
+		t.Fatalf("rewriteOpenFile returned error: %v", result.err)
+	}
+	if result.bytesRewritten != 10 {
+		t.Fatalf("bytes rewritten = %d, want 10", result.bytesRewritten)
+	}
+}
+
+func TestRewriteParanoidVerifiesEveryChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	original := bytes.Repeat([]byte("paranoid-"), 20)
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	readCount := 0
+	savedPread := preadFile
+	preadFile = func(fd int, buf []byte, offset int64) (int, error) {
+		readCount++
+		return savedPread(fd, buf, offset)
+	}
+	var dropped [][2]int64
+	savedDrop := dropCachedPages
+	dropCachedPages = func(fd int, offset, length int64) error {
+		dropped = append(dropped, [2]int64{offset, length})
+		return nil
+	}
+	t.Cleanup(func() {
+		preadFile = savedPread
+		dropCachedPages = savedDrop
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64, paranoid: true}, nil)
+	if result.err != nil {
+		t.Fatalf("processPath returned error: %v", result.err)
+	}
+	// Three data reads and three verify reads; the rewrite stops at the
+	// original size without a final read at EOF.
+	if readCount != 6 {
+		t.Fatalf("pread calls = %d, want 6", readCount)
+	}
+	// Each written chunk is dropped from the page cache, widened to whole
+	// pages, before it is read back.
+	page := int64(os.Getpagesize())
+	if want := [][2]int64{{0, page}, {0, page}, {0, page}}; !slices.Equal(dropped, want) {
+		t.Fatalf("dropped ranges = %v, want %v", dropped, want)
+	}
+}
+
+func TestRewriteParanoidFailsWhenFlushFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("paranoid"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	savedSync := syncFile
+	syncFile = func(fd int) error {
+		return syscall.EIO
+	}
+	t.Cleanup(func() { syncFile = savedSync })
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64, paranoid: true}, nil)
+	if !errors.Is(result.err, errVerify) || !errors.Is(result.err, syscall.EIO) {
+		t.Fatalf("processPath error = %v, want errVerify wrapping EIO", result.err)
+	}
+}
+
+func TestRewriteParanoidReportsMismatchOffset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	original := bytes.Repeat([]byte("paranoid-"), 20)
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	readCount := 0
+	savedPread := preadFile
+	preadFile = func(fd int, buf []byte, offset int64) (int, error) {
+		readCount++
+		n, err := savedPread(fd, buf, offset)
+		if readCount == 4 && n > 5 {
+			buf[5] ^= 0xff
+		}
+		return n, err
+	}
+	t.Cleanup(func() {
+		preadFile = savedPread
+		errorOutput = originalErrorOutput
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64, paranoid: true}, nil)
+	if !errors.Is(result.err, errVerify) {
+		t.Fatalf("processPath error = %v, want errVerify", result.err)
+	}
+	if !strings.Contains(stderr.String(), "Verification of "+path+" failed: data read back at offset 69 does not match") {
+		t.Fatalf("missing mismatch offset: %q", stderr.String())
+	}
+}
+
+func TestRewriteReadOnlyFilesystem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("readonly"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	originalInfoOutput := infoOutput
+	errorOutput = &stderr
+	infoOutput = &stderr
+	savedOpen := openFile
+	openFile = func(path string, mode int, perm uint32) (int, error) {
+		return -1, syscall.EROFS
+	}
+	t.Cleanup(func() {
+		openFile = savedOpen
+		errorOutput = originalErrorOutput
+		infoOutput = originalInfoOutput
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64}, nil)
+	if !errors.Is(result.err, errOpen) || !errors.Is(result.err, syscall.EROFS) {
+		t.Fatalf("processPath error = %v, want errOpen wrapping EROFS", result.err)
+	}
+	if stderr.String() != path+" is on a read-only filesystem, skipping.\n" {
+		t.Fatalf("stderr = %q, want read-only message", stderr.String())
+	}
+
+	stderr.Reset()
+	result = processPath(path, processOptions{bufferSizeBytes: 64, skipReadOnly: true}, nil)
+	if result.outcome != pathOutcomeSkippedReadOnly || result.err != nil {
+		t.Fatalf("result = %+v, want read-only skip without error", result)
+	}
+	if stderr.String() != "SKIP READONLY "+path+"\n" {
+		t.Fatalf("stderr = %q, want read-only skip line", stderr.String())
+	}
+}
+
+func TestCLIAbsPathReportsCanonicalPaths(t *testing.T) {
+	realDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(realDir, "data.txt"), []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	linkDir := filepath.Join(t.TempDir(), "linked")
+	if err := os.Symlink(realDir, linkDir); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+
+	exitCode, _, stderr := runCLIInDir(t, linkDir, "--dry-run", "--abspath", "data.txt")
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	want := "WOULD REWRITE " + filepath.Join(realDir, "data.txt") + "\n"
+	if stderr != want {
+		t.Fatalf("stderr = %q, want %q", stderr, want)
+	}
+}
+
+func TestCanonicalPathKeepsFinalSymlinkUnlessFollowing(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("resolve temp dir: %v", err)
+	}
+	target := filepath.Join(dir, "target.txt")
+	link := filepath.Join(dir, "link.txt")
+	if err := os.WriteFile(target, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("create symlink: %v", err)
+	}
+
+	if got := canonicalPath(link, false); got != link {
+		t.Fatalf("canonicalPath(link, false) = %q, want %q", got, link)
+	}
+	if got := canonicalPath(link, true); got != target {
+		t.Fatalf("canonicalPath(link, true) = %q, want %q", got, target)
+	}
+}
+
+func TestRewriteTimestampFailureIsSoftUnlessStrict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("soft-timestamp"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	syncCalls := 0
+	savedSync := syncFile
+	syncFile = func(fd int) error {
+		syncCalls++
+		if syncCalls%2 == 0 {
+			return syscall.EIO
+		}
+		return savedSync(fd)
+	}
+	t.Cleanup(func() {
+		syncFile = savedSync
+		errorOutput = originalErrorOutput
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64}, nil)
+	if result.outcome != pathOutcomeRewrittenTimesNotRestored || result.failed() {
+		t.Fatalf("outcome = %v, want soft timestamp outcome", result.outcome)
+	}
+	if !errors.Is(result.err, errSync) {
+		t.Fatalf("error = %v, want errSync", result.err)
+	}
+	if !strings.Contains(stderr.String(), path+" was rewritten, but its original timestamps may not have been restored.") {
+		t.Fatalf("missing soft timestamp warning: %q", stderr.String())
+	}
+
+	var stats runStats
+	stats.add(result)
+	if stats.rewritten != 1 || stats.timesNotRestored != 1 || stats.failures != 0 || stats.bytesRewritten != 14 {
+		t.Fatalf("stats = %+v, want one rewrite with timestamps not restored", stats)
+	}
+
+	result = processPath(path, processOptions{bufferSizeBytes: 64, strictTimes: true}, nil)
+	if result.outcome != pathOutcomeFailed || !errors.Is(result.err, errSync) {
+		t.Fatalf("strict result = %+v, want failure with errSync", result)
+	}
+}
+
+func TestAutotuneBufferSizeRemovesBenchmarkFile(t *testing.T) {
+	originalSample := autotuneSampleBytes
+	autotuneSampleBytes = 3*bytesPerMB + 17
+	t.Cleanup(func() {
+		autotuneSampleBytes = originalSample
+	})
+
+	dir := t.TempDir()
+	got, err := autotuneBufferSize(dir, []int{1, 2})
+	if err != nil {
+		t.Fatalf("autotuneBufferSize() error = %v", err)
+	}
+	if got != bytesPerMB && got != 2*bytesPerMB {
+		t.Fatalf("autotuneBufferSize() = %d, want one of the candidates", got)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("benchmark left %d entries behind", len(entries))
+	}
+}
+
+func TestCLIAutotune(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	content := bytes.Repeat([]byte("autotune"), 1024)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--autotune", "-v", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Autotune selected a ") {
+		t.Fatalf("stderr missing autotune choice: %q", stderr)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("file content changed")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("directory has %d entries after autotune, want 1", len(entries))
+	}
+
+	exitCode, _, stderr = runCLI(t, "--autotune", "--glob", "--glob-nomatch-ok", filepath.Join(dir, "nomatch*"))
+	if exitCode != exitNothingRewritten || strings.Contains(stderr, "panic") {
+		t.Fatalf("autotune with an empty glob: exit code = %d, want %d; stderr=%q", exitCode, exitNothingRewritten, stderr)
+	}
+}
+
+func TestProcessPathStopsAtOriginalSizeWhenFileGrows(t *testing.T) {
+	for _, followGrowth := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "growing.log")
+		if err := os.WriteFile(path, []byte("original data\n"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+
+		appended := false
+		savedWrite := pwriteFile
+		pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+			if !appended {
+				appended = true
+				f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatalf("open for append: %v", err)
+				}
+				_, _ = f.WriteString("appended\n")
+				_ = f.Close()
+			}
+			return savedWrite(fd, buf, offset)
+		}
+
+		result := processPath(path, processOptions{bufferSizeBytes: 4, followGrowth: followGrowth}, nil)
+		pwriteFile = savedWrite
+		if result.outcome != pathOutcomeRewritten {
+			t.Fatalf("followGrowth=%v: outcome = %v, want rewritten; err=%v", followGrowth, result.outcome, result.err)
+		}
+
+		want := int64(len("original data\n"))
+		if followGrowth {
+			want += int64(len("appended\n"))
+		}
+		if result.bytesRewritten != want {
+			t.Fatalf("followGrowth=%v: bytesRewritten = %d, want %d", followGrowth, result.bytesRewritten, want)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read file: %v", err)
+		}
+		if string(got) != "original data\nappended\n" {
+			t.Fatalf("followGrowth=%v: content = %q", followGrowth, got)
+		}
+	}
+}
+
+func TestRunProgressFDWritesJSONEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("p"), 3*bytesPerMB/2), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.bin")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+
+	var stderr bytes.Buffer
+	exitCode := run([]string{"-b", "1", "--progress-fd", strconv.Itoa(int(w.Fd())), path, missing}, nil, &stderr)
+	_ = w.Close()
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr.String())
+	}
+
+	var events []progressEvent
+	dec := json.NewDecoder(r)
+	for {
+		var event progressEvent
+		if err := dec.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	size := int64(3 * bytesPerMB / 2)
+	want := []progressEvent{
+		{Event: progressEventFileStart, Path: path},
+		{Event: progressEventFileProgress, Path: path, BytesDone: bytesPerMB, BytesTotal: size},
+		{Event: progressEventFileProgress, Path: path, BytesDone: size, BytesTotal: size},
+		{Event: progressEventFileDone, Path: path, BytesDone: size},
+		{Event: progressEventFileStart, Path: missing},
+		{Event: progressEventFileDone, Path: missing, Failed: true},
+		{Event: progressEventBatchDone, BytesDone: size, Files: 2, Failures: 1},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestCLIRejectsClosedProgressFD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--progress-fd", "99", path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "invalid progress fd 99") {
+		t.Fatalf("stderr missing progress fd error: %q", stderr)
+	}
+}
+
+func TestProcessPathNoAtimeOpenFallsBackOnEPERM(t *testing.T) {
+	if openNoAtime == 0 {
+		t.Skip("O_NOATIME is not supported on this platform")
+	}
+
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("noatime"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var flags []int
+	savedOpen := openFile
+	openFile = func(path string, mode int, perm uint32) (int, error) {
+		flags = append(flags, mode)
+		if mode&openNoAtime != 0 {
+			return -1, syscall.EPERM
+		}
+		return savedOpen(path, mode, perm)
+	}
+	t.Cleanup(func() { openFile = savedOpen })
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64, noAtimeOpen: true}, nil)
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten; err=%v", result.outcome, result.err)
+	}
+	if len(flags) != 2 || flags[0]&openNoAtime == 0 || flags[1]&openNoAtime != 0 {
+		t.Fatalf("open flags = %#v, want O_NOATIME attempt followed by plain open", flags)
+	}
+
+	flags = nil
+	result = processPath(path, processOptions{bufferSizeBytes: 64}, nil)
+	if result.outcome != pathOutcomeRewritten || len(flags) != 1 || flags[0]&openNoAtime != 0 {
+		t.Fatalf("default open flags = %#v, outcome = %v; want a single open without O_NOATIME", flags, result.outcome)
+	}
+}
+
+func TestProcessPathWaitsForLeaseAfterNonblockingOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("leased"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var flags []int
+	savedOpen := openFile
+	openFile = func(path string, mode int, perm uint32) (int, error) {
+		flags = append(flags, mode)
+		if mode&syscall.O_NONBLOCK != 0 {
+			return -1, syscall.EWOULDBLOCK
+		}
+		return savedOpen(path, mode, perm)
+	}
+	t.Cleanup(func() { openFile = savedOpen })
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64}, nil)
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten; err=%v", result.outcome, result.err)
+	}
+	if len(flags) != 2 || flags[0] != defaultOpenFlags|syscall.O_NONBLOCK || flags[1] != defaultOpenFlags {
+		t.Fatalf("open flags = %#x, want a non-blocking open followed by a blocking one", flags)
+	}
+}
+
+func TestProcessPathOpenFlagsReplaceDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("open flags"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var flags []int
+	savedOpen := openFile
+	openFile = func(path string, mode int, perm uint32) (int, error) {
+		flags = append(flags, mode)
+		return savedOpen(path, mode, perm)
+	}
+	t.Cleanup(func() { openFile = savedOpen })
+
+	result := processPath(path, processOptions{bufferSizeBytes: 64}, nil)
+	if result.outcome != pathOutcomeRewritten || len(flags) != 1 || flags[0] != defaultOpenFlags|syscall.O_NONBLOCK {
+		t.Fatalf("default open flags = %#x, outcome = %v; want O_RDWR|O_NOFOLLOW|O_NONBLOCK", flags, result.outcome)
+	}
+
+	flags = nil
+	result = processPath(path, processOptions{bufferSizeBytes: 64, openFlags: syscall.O_RDWR | syscall.O_SYNC}, nil)
+	if result.outcome != pathOutcomeRewritten || len(flags) != 1 || flags[0] != syscall.O_RDWR|syscall.O_SYNC|syscall.O_NONBLOCK {
+		t.Fatalf("custom open flags = %#x, outcome = %v; want O_RDWR|O_SYNC|O_NONBLOCK", flags, result.outcome)
+	}
+}
+
+func TestLoadExcludePatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exclude.txt")
+	content := "# build output\n*.o\n\n  cache/*.tmp  \n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write patterns: %v", err)
+	}
+
+	patterns, err := loadExcludePatterns(path)
+	if err != nil {
+		t.Fatalf("loadExcludePatterns() error = %v", err)
+	}
+	if len(patterns) != 2 || patterns[0] != "*.o" || patterns[1] != "cache/*.tmp" {
+		t.Fatalf("patterns = %q", patterns)
+	}
+
+	tests := map[string]bool{
+		"main.o":          true,
+		"dir/main.o":      true,
+		"main.c":          false,
+		"cache/a.tmp":     true,
+		"other/cache.tmp": false,
+	}
+	for path, want := range tests {
+		if got := excludedBy(patterns, path); got != want {
+			t.Fatalf("excludedBy(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := loadExcludePatterns(missing); !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "read exclude patterns "+missing) {
+		t.Fatalf("loadExcludePatterns(missing) error = %v, want a not-exist error naming the file", err)
+	}
+}
+
+func TestLoadExcludePatternsRejectsBadPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exclude.txt")
+	if err := os.WriteFile(path, []byte("ok\n[\n"), 0o644); err != nil {
+		t.Fatalf("write patterns: %v", err)
+	}
+
+	_, err := loadExcludePatterns(path)
+	if err == nil || !strings.Contains(err.Error(), path+":2") {
+		t.Fatalf("loadExcludePatterns() error = %v, want error naming line 2", err)
+	}
+}
+
+func TestCLIExcludeFrom(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "keep.txt")
+	skipped := filepath.Join(dir, "skip.log")
+	for _, path := range []string{kept, skipped} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	patterns := filepath.Join(dir, "exclude.txt")
+	if err := os.WriteFile(patterns, []byte("# logs\n*.log\n"), 0o644); err != nil {
+		t.Fatalf("write patterns: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--exclude-from", patterns, "--stats", kept, skipped)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "SKIP FILTERED "+skipped) || strings.Contains(stderr, "SKIP FILTERED "+kept) {
+		t.Fatalf("stderr did not skip only the excluded path: %q", stderr)
+	}
+	if !strings.Contains(stderr, " rewritten=1 ") || !strings.Contains(stderr, " skipped_filtered=1 ") {
+		t.Fatalf("stderr missing expected summary counts: %q", stderr)
+	}
+}
+
+func TestCLITouchOnlySetsTimeWithoutRewriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("touch"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	writes := 0
+	savedWrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		writes++
+		return savedWrite(fd, buf, offset)
+	}
+	t.Cleanup(func() { pwriteFile = savedWrite })
+
+	var stderr bytes.Buffer
+	exitCode := run([]string{"--touch-only", "--time", "2024-01-02T03:04:05Z", "--stats", path}, nil, &stderr)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr.String())
+	}
+	if writes != 0 {
+		t.Fatalf("pwrite calls = %d, want 0", writes)
+	}
+	if !strings.Contains(stderr.String(), " rewritten=0 ") || !strings.Contains(stderr.String(), " touched=1 ") {
+		t.Fatalf("summary did not count a touch: %q", stderr.String())
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !info.ModTime().Equal(want) {
+		t.Fatalf("mtime = %v, want %v", info.ModTime(), want)
+	}
+}
+
+func TestCLITouchOnlyPreservesTimesByDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("touch"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	mtime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--touch-only", "-v", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Touched "+path+".") {
+		t.Fatalf("stderr missing touch line: %q", stderr)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestCLITimeRequiresTouchOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("touch"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"--time", "now", path},
+		{"--touch-only", "--time", "yesterday", path},
+	} {
+		exitCode, _, stderr := runCLI(t, args...)
+		if exitCode != 2 {
+			t.Fatalf("%v: exit code = %d, want 2; stderr=%q", args, exitCode, stderr)
+		}
+	}
+}
+
+func TestProcessPathSkipIfClean(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("clean content"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var marker string
+	savedRead, savedWrite := readContentMarker, writeContentMarker
+	readContentMarker = func(fd int) (string, error) {
+		return marker, nil
+	}
+	writeContentMarker = func(fd int, value string) error {
+		marker = value
+		return nil
+	}
+	t.Cleanup(func() {
+		readContentMarker, writeContentMarker = savedRead, savedWrite
+	})
+
+	options := processOptions{bufferSizeBytes: 4, skipIfClean: true}
+	result := processPath(path, options, nil)
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("first run outcome = %v, want rewritten; err=%v", result.outcome, result.err)
+	}
+	sum := sha256.Sum256([]byte("clean content"))
+	if want := "1:" + hex.EncodeToString(sum[:]); marker != want {
+		t.Fatalf("stored marker = %q, want %q", marker, want)
+	}
+
+	result = processPath(path, options, nil)
+	if result.outcome != pathOutcomeSkippedClean || result.failed() {
+		t.Fatalf("second run outcome = %v, want skipped clean", result.outcome)
+	}
+
+	if err := os.WriteFile(path, []byte("changed content"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	previous := marker
+	result = processPath(path, options, nil)
+	if result.outcome != pathOutcomeRewritten || marker == previous {
+		t.Fatalf("changed file outcome = %v, marker updated = %v; want rewrite with new marker", result.outcome, marker != previous)
+	}
+}
+
+func TestProcessPathSkipIfCleanIgnoresUnversionedMarker(t *testing.T) {
+	content := []byte("legacy marker")
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	// Markers written before versioning hold the bare hash.
+	sum := sha256.Sum256(content)
+	marker := hex.EncodeToString(sum[:])
+	savedRead, savedWrite := readContentMarker, writeContentMarker
+	readContentMarker = func(fd int) (string, error) {
+		return marker, nil
+	}
+	writeContentMarker = func(fd int, value string) error {
+		marker = value
+		return nil
+	}
+	var stderr bytes.Buffer
+	savedErrorOutput, savedVerbosity := errorOutput, verbosity
+	errorOutput, verbosity = &stderr, verbosityFiles
+	t.Cleanup(func() {
+		readContentMarker, writeContentMarker = savedRead, savedWrite
+		errorOutput, verbosity = savedErrorOutput, savedVerbosity
+	})
+
+	options := processOptions{bufferSizeBytes: 4, skipIfClean: true}
+	result := processPath(path, options, nil)
+	if result.outcome != pathOutcomeRewritten {
+		t.Fatalf("outcome = %v, want rewritten; err=%v", result.outcome, result.err)
+	}
+	if !strings.Contains(stderr.String(), "Ignoring content marker on "+path+" written by an incompatible version.") {
+		t.Fatalf("stderr missing ignored-marker log: %q", stderr.String())
+	}
+	if want := contentMarkerValue(hex.EncodeToString(sum[:])); marker != want {
+		t.Fatalf("marker = %q, want %q", marker, want)
+	}
+
+	result = processPath(path, options, nil)
+	if result.outcome != pathOutcomeSkippedClean {
+		t.Fatalf("second run outcome = %v, want skipped clean", result.outcome)
+	}
+}
+
+func TestRewriteChunkSizeSplitsWritesAndProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	original := bytes.Repeat([]byte("0123456789"), 5)
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var writes []int
+	savedWrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		writes = append(writes, len(buf))
+		return savedWrite(fd, buf, offset)
+	}
+	t.Cleanup(func() { pwriteFile = savedWrite })
+
+	var progress []int64
+	options := processOptions{
+		bufferSizeBytes: 32,
+		chunkSizeBytes:  12,
+		progressFunc: func(_ string, done, _ int64) {
+			progress = append(progress, done)
+		},
+	}
+	result := processPath(path, options, nil)
+	if result.outcome != pathOutcomeRewritten || result.bytesRewritten != 50 {
+		t.Fatalf("result = %+v, want 50 bytes rewritten", result)
+	}
+	if want := []int{12, 12, 8, 12, 6}; fmt.Sprint(writes) != fmt.Sprint(want) {
+		t.Fatalf("write sizes = %v, want %v", writes, want)
+	}
+	if want := []int64{12, 24, 32, 44, 50}; fmt.Sprint(progress) != fmt.Sprint(want) {
+		t.Fatalf("progress = %v, want %v", progress, want)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Fatal("file content changed")
+	}
+}
+
+func TestCLIRejectsChunkSizeLargerThanBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "-b", "2", "--chunk-size", "4", path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "invalid chunk size 4 MB") {
+		t.Fatalf("stderr missing chunk size error: %q", stderr)
+	}
+}
+
+func TestUntilDeadline(t *testing.T) {
+	now := time.Date(2024, 3, 10, 22, 30, 0, 0, time.UTC)
+
+	got, err := untilDeadline(now, "06:00")
+	if err != nil {
+		t.Fatalf("untilDeadline() error = %v", err)
+	}
+	if want := time.Date(2024, 3, 11, 6, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("untilDeadline(06:00) = %v, want %v", got, want)
+	}
+
+	got, err = untilDeadline(now, "23:15")
+	if err != nil {
+		t.Fatalf("untilDeadline() error = %v", err)
+	}
+	if want := time.Date(2024, 3, 10, 23, 15, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("untilDeadline(23:15) = %v, want %v", got, want)
+	}
+
+	if _, err := untilDeadline(now, "6am"); err == nil {
+		t.Fatal("untilDeadline(6am) succeeded, want error")
+	}
+}
+
+func TestCLIDeadlineStopsStartingFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+
+	exitCode, _, stderr := runCLI(t, "--deadline", "1ns", "--stats", first, second)
+	if exitCode != exitDeadlineReached {
+		t.Fatalf("exit code = %d, want %d; stderr=%q", exitCode, exitDeadlineReached, stderr)
+	}
+	if !strings.Contains(stderr, "Deadline reached; 2 of 2 paths were not started.") {
+		t.Fatalf("stderr missing deadline warning: %q", stderr)
+	}
+	if !strings.Contains(stderr, "Summary: paths=0 ") || !strings.Contains(stderr, " not_started=2") {
+		t.Fatalf("stderr missing partial summary: %q", stderr)
+	}
+}
+
+func TestCLIIODelayRunsPastDeadline(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+
+	start := time.Now()
+	exitCode, _, stderr := runCLI(t, "--io-delay", "300ms", "--deadline", "150ms", "--stats", first, second)
+	if exitCode != exitDeadlineReached {
+		t.Fatalf("exit code = %d, want %d; stderr=%q", exitCode, exitDeadlineReached, stderr)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("run took %s, want at least the injected delay", elapsed)
+	}
+	if !strings.Contains(stderr, "Summary: paths=1 rewritten=1 ") || !strings.Contains(stderr, " not_started=1") {
+		t.Fatalf("stderr = %q, want the delayed file finished and the next not started", stderr)
+	}
+
+	if exitCode, _, _ := runCLI(t, "--io-delay", "-1s", first); exitCode != 2 {
+		t.Fatalf("negative delay exit code = %d, want 2", exitCode)
+	}
+	if _, _, help := runCLI(t, "--help"); strings.Contains(help, "io-delay") {
+		t.Fatalf("help lists hidden testing flag: %q", help)
+	}
+}
+
+func TestCLIDeadlineKeepsFailureStatus(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.txt")
+	slow := filepath.Join(dir, "slow.txt")
+	later := filepath.Join(dir, "later.txt")
+	for _, path := range []string{slow, later} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+
+	exitCode, _, stderr := runCLI(t, "--io-delay", "300ms", "--deadline", "150ms", "--stats", missing, slow, later)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1 for the failed path; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, " failures=1 ") || !strings.Contains(stderr, " not_started=1") {
+		t.Fatalf("stderr = %q, want one failure and one path not started", stderr)
+	}
+}
+
+func TestCLIDeadlineAndUntilConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--deadline", "1h", "--until", "06:00", path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.img", "a.img", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	literal := filepath.Join(dir, "literal.txt")
+
+	got, err := expandGlobs([]string{filepath.Join(dir, "*.img"), literal}, false)
+	if err != nil {
+		t.Fatalf("expandGlobs() error = %v", err)
+	}
+	want := []string{filepath.Join(dir, "a.img"), filepath.Join(dir, "b.img"), literal}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expandGlobs() = %q, want %q", got, want)
+	}
+
+	nomatch := filepath.Join(dir, "*.iso")
+	if _, err := expandGlobs([]string{nomatch}, false); err == nil || !strings.Contains(err.Error(), "matched no files") {
+		t.Fatalf("expandGlobs() error = %v, want no-match error", err)
+	}
+	got, err = expandGlobs([]string{nomatch, literal}, true)
+	if err != nil || len(got) != 1 || got[0] != literal {
+		t.Fatalf("expandGlobs() with nomatch ok = %q, %v; want only the literal path", got, err)
+	}
+}
+
+func TestCLIGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.img", "b.img"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+
+	exitCode, _, stderr := runCLI(t, "--glob", "--stats", filepath.Join(dir, "*.img"))
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Summary: paths=2 rewritten=2 ") {
+		t.Fatalf("stderr missing expected summary: %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--glob", filepath.Join(dir, "*.iso"))
+	if exitCode != 2 {
+		t.Fatalf("no-match exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIReportsEmptySelection(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "skip.log")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	patterns := filepath.Join(dir, "exclude.txt")
+	if err := os.WriteFile(patterns, []byte("*.log\n"), 0o644); err != nil {
+		t.Fatalf("write patterns: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--exclude-from", patterns, path)
+	if exitCode != exitNothingRewritten {
+		t.Fatalf("exit code = %d, want %d; stderr=%q", exitCode, exitNothingRewritten, stderr)
+	}
+	if !strings.Contains(stderr, "0 files processed: 1 of 1 paths were filtered out.") {
+		t.Fatalf("stderr missing empty selection line: %q", stderr)
+	}
+	if !strings.Contains(stderr, "Summary: paths=1 rewritten=0 ") || !strings.Contains(stderr, " skipped_filtered=1 ") {
+		t.Fatalf("stderr missing summary: %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--glob", "--glob-nomatch-ok", filepath.Join(dir, "*.iso"))
+	if exitCode != exitNothingRewritten {
+		t.Fatalf("glob exit code = %d, want %d; stderr=%q", exitCode, exitNothingRewritten, stderr)
+	}
+	if !strings.Contains(stderr, "0 files processed: 0 of 0 paths were filtered out.") || !strings.Contains(stderr, "Summary: paths=0 ") {
+		t.Fatalf("stderr missing empty glob report: %q", stderr)
+	}
+
+	// Paths from --retry-failed still run when the glob matched nothing.
+	retryLog := filepath.Join(t.TempDir(), "errors.log")
+	if err := os.WriteFile(retryLog, []byte(path+"\tstat failed: no such file or directory\n"), 0o644); err != nil {
+		t.Fatalf("write error log: %v", err)
+	}
+	exitCode, _, stderr = runCLI(t, "--stats", "--glob", "--glob-nomatch-ok", "--retry-failed", retryLog, filepath.Join(dir, "*.iso"))
+	if exitCode != 0 || !strings.Contains(stderr, "Summary: paths=1 rewritten=1 ") {
+		t.Fatalf("empty glob with --retry-failed: exit=%d stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLISimulateErrorRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--simulate-error-rate", "1", "--stats", path)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Simulated failure for "+path) || !strings.Contains(stderr, " failures=1 ") {
+		t.Fatalf("stderr missing simulated failure: %q", stderr)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("mtime = %v, want untouched %v", info.ModTime(), mtime)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--simulate-error-rate", "0", path)
+	if exitCode != 0 {
+		t.Fatalf("zero rate exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+
+	exitCode, _, _ = runCLI(t, "--simulate-error-rate", "1.5", path)
+	if exitCode != 2 {
+		t.Fatalf("out of range exit code = %d, want 2", exitCode)
+	}
+
+	_, _, help := runCLI(t, "--help")
+	if strings.Contains(help, "simulate-error-rate") {
+		t.Fatalf("help lists hidden testing flag: %q", help)
+	}
+}
+
+func TestDeviceFilesystemTypeCachesPerDevice(t *testing.T) {
+	calls := 0
+	savedStatfs := statfsType
+	savedCache := filesystemTypes
+	statfsType = func(fd int) (string, error) {
+		calls++
+		return "btrfs", nil
+	}
+	filesystemTypes = map[uint64]string{}
+	t.Cleanup(func() {
+		statfsType = savedStatfs
+		filesystemTypes = savedCache
+	})
+
+	a := syscall.Stat_t{Dev: 1}
+	b := syscall.Stat_t{Dev: 2}
+	for _, sb := range []*syscall.Stat_t{&a, &a, &b, &a} {
+		if got := deviceFilesystemType(-1, sb); got != "btrfs" {
+			t.Fatalf("deviceFilesystemType() = %q, want btrfs", got)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("statfs calls = %d, want one per device", calls)
+	}
+}
+
+func TestCLIVerboseChunksReportsFilesystemType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	_, _, stderr := runCLI(t, "-v", path)
+	if strings.Contains(stderr, " filesystem.") {
+		t.Fatalf("-v output includes filesystem type: %q", stderr)
+	}
+	exitCode, _, stderr := runCLI(t, "-vv", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, path+" is on a ") || !strings.Contains(stderr, " filesystem.") {
+		t.Fatalf("-vv output missing filesystem type: %q", stderr)
+	}
+}
+
+func TestFstypeFilterSelectsByType(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("fstype"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	calls := 0
+	savedStatfs := statfsType
+	savedCache := filesystemTypes
+	statfsType = func(fd int) (string, error) {
+		calls++
+		return "ext2/ext3/ext4", nil
+	}
+	filesystemTypes = map[uint64]string{}
+	savedInfoOutput := infoOutput
+	infoOutput = io.Discard
+	t.Cleanup(func() {
+		statfsType = savedStatfs
+		filesystemTypes = savedCache
+		infoOutput = savedInfoOutput
+	})
+
+	if got := parseFstypeList(" tmpfs, ,NFS,"); fmt.Sprint(got) != "[tmpfs NFS]" {
+		t.Fatalf("parseFstypeList() = %q, want [tmpfs NFS]", got)
+	}
+	for _, tc := range []struct {
+		skip, only string
+		outcome    pathOutcome
+	}{
+		{"tmpfs,nfs", "", pathOutcomeRewritten},
+		{"EXT4", "", pathOutcomeSkippedFiltered},
+		{"ext2/ext3/ext4", "", pathOutcomeSkippedFiltered},
+		{"", "ext4,xfs", pathOutcomeRewritten},
+		{"", "xfs", pathOutcomeSkippedFiltered},
+		{"ext4", "ext4,xfs", pathOutcomeSkippedFiltered},
+	} {
+		options := processOptions{bufferSizeBytes: 64, shouldRewrite: fstypeFilter(parseFstypeList(tc.skip), parseFstypeList(tc.only), false)}
+		if result := processPath(path, options, nil); result.outcome != tc.outcome {
+			t.Fatalf("--skip-fstype %q --only-fstype %q: outcome = %v, want %v", tc.skip, tc.only, result.outcome, tc.outcome)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("statfs calls = %d, want one for the device", calls)
+	}
+}
+
+func TestCLIFstypeConflictWarnings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("fstype"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	_, _, stderr := runCLI(t, "--dry-run", "--skip-fstype", "nfs,xfs", "--only-fstype", "xfs", path)
+	if !strings.Contains(stderr, "xfs is in both --only-fstype and --skip-fstype") || !strings.Contains(stderr, "no files will be selected") {
+		t.Fatalf("missing conflict warnings: %q", stderr)
+	}
+	_, _, stderr = runCLI(t, "--dry-run", "--only-fstype", ",", path)
+	if !strings.Contains(stderr, `--only-fstype "," names no filesystem types`) || !strings.Contains(stderr, "WOULD REWRITE "+path) {
+		t.Fatalf("empty --only-fstype not reported and ignored: %q", stderr)
+	}
+}
+
+func TestVerifyReadableReportsReadFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("verify pass"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := verifyReadable(path, 4, false); err != nil {
+		t.Fatalf("verifyReadable() error = %v for a readable file", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	savedPread := preadFile
+	preadFile = func(fd int, buf []byte, offset int64) (int, error) {
+		if offset >= 4 {
+			return 0, syscall.EIO
+		}
+		return savedPread(fd, buf, offset)
+	}
+	t.Cleanup(func() {
+		preadFile = savedPread
+		errorOutput = originalErrorOutput
+	})
+
+	if err := verifyReadable(path, 4, false); !errors.Is(err, errVerify) || !errors.Is(err, syscall.EIO) {
+		t.Fatalf("verifyReadable() error = %v, want errVerify wrapping EIO", err)
+	}
+	if !strings.Contains(stderr.String(), "Verify pass read from "+path+" at offset 4 failed") {
+		t.Fatalf("missing verify pass warning: %q", stderr.String())
+	}
+}
+
+func TestCLIVerifyPass(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--verify-pass", "--stats", "-v", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Verify pass read 4 bytes of "+path+".") || !strings.Contains(stderr, " verify_failures=0") {
+		t.Fatalf("stderr missing verify pass output: %q", stderr)
+	}
+}
+
+func TestVerifyReadableDropsPageCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var dropped [][2]int64
+	savedDrop, savedSync := dropCachedPages, syncFile
+	dropCachedPages = func(fd int, offset, length int64) error {
+		dropped = append(dropped, [2]int64{offset, length})
+		return nil
+	}
+	t.Cleanup(func() {
+		dropCachedPages = savedDrop
+		syncFile = savedSync
+	})
+
+	if err := verifyReadable(path, 64, false); err != nil {
+		t.Fatalf("verifyReadable: %v", err)
+	}
+	if want := [][2]int64{{0, 0}}; !slices.Equal(dropped, want) {
+		t.Fatalf("dropped ranges = %v, want the whole file %v", dropped, want)
+	}
+
+	syncFile = func(fd int) error {
+		return syscall.EIO
+	}
+	if err := verifyReadable(path, 64, false); !errors.Is(err, errVerify) || !errors.Is(err, syscall.EIO) {
+		t.Fatalf("verifyReadable error = %v, want errVerify wrapping EIO", err)
+	}
+}
+
+func TestCLIDiagnosticsStayOffStdout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+
+	for _, args := range [][]string{
+		{"-vvv", "--stats", path, missing},
+		{"--dry-run", "--stats", path, missing},
+	} {
+		_, stdout, stderr := runCLI(t, args...)
+		if stdout != "" {
+			t.Fatalf("%v: stdout = %q, want empty", args, stdout)
+		}
+		if !strings.Contains(stderr, "Summary: ") {
+			t.Fatalf("%v: stderr missing summary: %q", args, stderr)
+		}
+	}
+}
+
+func TestParseTimeValue(t *testing.T) {
+	got, err := parseTimeValue("1700000000")
+	if err != nil || !got.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("parseTimeValue(epoch) = %v, %v", got, err)
+	}
+	got, err = parseTimeValue("2024-01-02T03:04:05.5Z")
+	if err != nil || !got.Equal(time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC)) {
+		t.Fatalf("parseTimeValue(RFC 3339) = %v, %v", got, err)
+	}
+	if _, err := parseTimeValue("now"); err != nil {
+		t.Fatalf("parseTimeValue(now) error = %v", err)
+	}
+	if _, err := parseTimeValue("yesterday"); err == nil {
+		t.Fatal("parseTimeValue(yesterday) succeeded, want error")
+	}
+}
+
+func TestCLISetAtimeAndMtime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--set-mtime", "1700000000", "--set-atime", "2024-01-02T03:04:05Z", path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+
+	var sb syscall.Stat_t
+	if err := syscall.Stat(path, &sb); err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	atime, mtime, ok := statTimes(&sb)
+	if !ok {
+		t.Skip("stat timestamps unsupported")
+	}
+	if mtime.Sec != 1700000000 {
+		t.Fatalf("mtime = %d, want 1700000000", mtime.Sec)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix(); int64(atime.Sec) != want {
+		t.Fatalf("atime = %d, want %d", atime.Sec, want)
+	}
+
+	exitCode, _, _ = runCLI(t, "--touch-only", "--time", "1600000000", "--set-mtime", "1500000000", path)
+	if exitCode != 0 {
+		t.Fatalf("touch exit code = %d, want 0", exitCode)
+	}
+	if err := syscall.Stat(path, &sb); err != nil {
+		t.Fatalf("stat file: %v", err)
+	}
+	atime, mtime, _ = statTimes(&sb)
+	if atime.Sec != 1600000000 || mtime.Sec != 1500000000 {
+		t.Fatalf("atime, mtime = %d, %d; want 1600000000, 1500000000", atime.Sec, mtime.Sec)
+	}
+}
+
+func TestCLICountOnly(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.bin")
+	second := filepath.Join(dir, "second.bin")
+	excluded := filepath.Join(dir, "skip.log")
+	if err := os.WriteFile(first, bytes.Repeat([]byte("a"), 100), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.WriteFile(second, bytes.Repeat([]byte("b"), 23), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.WriteFile(excluded, bytes.Repeat([]byte("c"), 50), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	patterns := filepath.Join(dir, "exclude.txt")
+	if err := os.WriteFile(patterns, []byte("*.log\n"), 0o644); err != nil {
+		t.Fatalf("write patterns: %v", err)
+	}
+
+	exitCode, stdout, stderr := runCLI(t, "--count-only", "--exclude-from", patterns, first, second, excluded)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if stdout != "files=2 bytes=123\n" {
+		t.Fatalf("stdout = %q, want %q", stdout, "files=2 bytes=123\n")
+	}
+	if stderr != "" {
+		t.Fatalf("stderr = %q, want no per-file output", stderr)
+	}
+}
+
+func TestRewriteFileHandlesShortReads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	original := []byte("short reads must not end the rewrite early")
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	originalErrorOutput := errorOutput
+	errorOutput = &stderr
+	verbosity = verbosityChunks
+	reads := 0
+	savedPread := preadFile
+	preadFile = func(fd int, buf []byte, offset int64) (int, error) {
+		reads++
+		if len(buf) > 5 {
+			buf = buf[:5]
+		}
+		return savedPread(fd, buf, offset)
+	}
+	var writes []int64
+	savedWrite := pwriteFile
+	pwriteFile = func(fd int, buf []byte, offset int64) (int, error) {
+		writes = append(writes, offset)
+		return savedWrite(fd, buf, offset)
+	}
+	t.Cleanup(func() {
+		preadFile = savedPread
+		pwriteFile = savedWrite
+		errorOutput = originalErrorOutput
+		verbosity = 0
+	})
+
+	result := processPath(path, processOptions{bufferSizeBytes: 16}, nil)
+	if result.outcome != pathOutcomeRewritten || result.bytesRewritten != int64(len(original)) {
+		t.Fatalf("result = %+v, want all %d bytes rewritten", result, len(original))
+	}
+	if want := (len(original) + 4) / 5; reads != want {
+		t.Fatalf("pread calls = %d, want %d", reads, want)
+	}
+	for i, offset := range writes {
+		if offset != int64(i*5) {
+			t.Fatalf("write %d at offset %d, want %d", i, offset, i*5)
+		}
+	}
+	if !strings.Contains(stderr.String(), "Short read from "+path+" at offset 0 (5 of 16 bytes); continuing.") {
+		t.Fatalf("missing short read log: %q", stderr.String())
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if !bytes.Equal(got, original) {
+		t.Fatalf("content = %q, want %q", got, original)
+	}
+}
+
+func TestCLIErrorLogAppendsFailures(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing.txt")
+	logPath := filepath.Join(dir, "errors.log")
+
+	for range 2 {
+		exitCode, _, stderr := runCLI(t, "--error-log", logPath, path, missing)
+		if exitCode != 1 {
+			t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+		}
+	}
+
+	got, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read error log: %v", err)
+	}
+	line := missing + "\tstat failed: no such file or directory\n"
+	if string(got) != line+line {
+		t.Fatalf("error log = %q, want two lines of %q", got, line)
+	}
+}
+
+func TestCLIRetryFailedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	flaky := filepath.Join(dir, "flaky\tname\nwith\\n.txt")
+	missing := filepath.Join(dir, "missing.txt")
+	firstLog := filepath.Join(dir, "first.log")
+
+	exitCode, _, stderr := runCLI(t, "--error-log", firstLog, flaky, missing, flaky)
+	if exitCode != 1 {
+		t.Fatalf("first run exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	logged, err := os.ReadFile(firstLog)
+	if err != nil {
+		t.Fatalf("read error log: %v", err)
+	}
+	escaped := filepath.Join(dir, `flaky\tname\nwith\\n.txt`) + "\tstat failed: no such file or directory\n"
+	if !strings.HasPrefix(string(logged), escaped) || strings.Count(string(logged), "\n") != 3 {
+		t.Fatalf("error log = %q, want escaped lines starting with %q", logged, escaped)
+	}
+	if err := os.WriteFile(flaky, []byte("back"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	retryLog := filepath.Join(dir, "retry.log")
+	exitCode, _, stderr = runCLI(t, "--retry-failed", firstLog, "--error-log", retryLog, "--stats")
+	if exitCode != 1 || !strings.Contains(stderr, "Summary: paths=2 rewritten=1 ") {
+		t.Fatalf("retry exit=%d stderr=%q", exitCode, stderr)
+	}
+	got, err := os.ReadFile(retryLog)
+	if err != nil {
+		t.Fatalf("read retry log: %v", err)
+	}
+	if want := missing + "\tstat failed: no such file or directory\n"; string(got) != want {
+		t.Fatalf("retry log = %q, want %q", got, want)
+	}
+
+	empty := filepath.Join(dir, "empty.log")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatalf("write empty log: %v", err)
+	}
+	if exitCode, _, _ := runCLI(t, "--retry-failed", empty); exitCode != exitNothingRewritten {
+		t.Fatalf("empty log exit code = %d, want %d", exitCode, exitNothingRewritten)
+	}
+	malformed := filepath.Join(dir, "malformed.log")
+	if err := os.WriteFile(malformed, []byte("no tab here\n"), 0o644); err != nil {
+		t.Fatalf("write malformed log: %v", err)
+	}
+	for _, args := range [][]string{{"--retry-failed", malformed}, {"--retry-failed", retryLog, "--error-log", retryLog}} {
+		if exitCode, _, _ := runCLI(t, args...); exitCode != 2 {
+			t.Fatalf("%v exit code = %d, want 2", args, exitCode)
+		}
+	}
+}
+
+func TestCLIErrorLogUnwritable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--error-log", filepath.Join(t.TempDir(), "missing", "errors.log"), path)
+	if exitCode != 2 {
+		t.Fatalf("exit code = %d, want 2; stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIManifest(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("manifest"), 1000)
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	empty := filepath.Join(dir, "empty.bin")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatalf("write empty file: %v", err)
+	}
+	odd := filepath.Join(dir, "back\\slash")
+	if err := os.WriteFile(odd, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing.bin")
+	manifestPath := filepath.Join(dir, "out.sha256")
+
+	exitCode, _, stderr := runCLI(t, "--manifest", manifestPath, "--buffersize", "1", path, missing, empty, odd)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	got, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	emptySum := sha256.Sum256(nil)
+	oddSum := sha256.Sum256([]byte("x"))
+	want := hex.EncodeToString(sum[:]) + "  " + path + "\n" +
+		hex.EncodeToString(emptySum[:]) + "  " + empty + "\n" +
+		"\\" + hex.EncodeToString(oddSum[:]) + "  " + strings.ReplaceAll(odd, "\\", "\\\\") + "\n"
+	if string(got) != want {
+		t.Fatalf("manifest = %q, want %q", got, want)
+	}
+
+	for _, flagArgs := range [][]string{{"--reverse"}, {"--stride", "2"}, {"--dry-run"}, {"--touch-only"}} {
+		args := append([]string{"--manifest", manifestPath}, flagArgs...)
+		if exitCode, _, _ := runCLI(t, append(args, path)...); exitCode != 2 {
+			t.Fatalf("%v exit code = %d, want 2", flagArgs, exitCode)
+		}
+	}
+}
+
+func TestCLICompareManifest(t *testing.T) {
+	dir := t.TempDir()
+	same := filepath.Join(dir, "same.bin")
+	changed := filepath.Join(dir, "changed.bin")
+	added := filepath.Join(dir, "added.bin")
+	for _, path := range []string{same, changed} {
+		if err := os.WriteFile(path, []byte("original"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	manifestPath := filepath.Join(dir, "prev.sha256")
+	if exitCode, _, stderr := runCLI(t, "--manifest", manifestPath, same, changed); exitCode != 0 {
+		t.Fatalf("manifest run exit code = %d; stderr=%q", exitCode, stderr)
+	}
+	if err := os.WriteFile(changed, []byte("rotted!!"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.WriteFile(added, []byte("new"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, stdout, stderr := runCLI(t, "--compare-manifest", manifestPath, "--stats", same, changed, added)
+	if exitCode != exitManifestMismatch {
+		t.Fatalf("exit code = %d, want %d; stderr=%q", exitCode, exitManifestMismatch, stderr)
+	}
+	if !strings.Contains(stderr, "MISMATCH "+changed+": manifest has ") || strings.Contains(stderr, "MISMATCH "+same) {
+		t.Fatalf("stderr = %q, want a mismatch for %s only", stderr, changed)
+	}
+	if !strings.Contains(stderr, "1 files did not match "+manifestPath+":\n  "+changed+"\n") {
+		t.Fatalf("stderr = %q, want the mismatch listed after the run", stderr)
+	}
+	if !strings.Contains(stdout+stderr, "NEW "+added+": not in the manifest") {
+		t.Fatalf("output = %q, want %s noted as new", stdout+stderr, added)
+	}
+	if !strings.Contains(stdout+stderr, " manifest_mismatches=1 manifest_new=1") {
+		t.Fatalf("output = %q, want mismatch counts in the summary", stdout+stderr)
+	}
+	if got, err := os.ReadFile(changed); err != nil || string(got) != "rotted!!" {
+		t.Fatalf("content = %q, %v; want the current data rewritten unchanged", got, err)
+	}
+
+	// Paths are compared in their cleaned form.
+	if exitCode, _, stderr := runCLIInDir(t, dir, "--manifest", "relative.sha256", "./same.bin"); exitCode != 0 {
+		t.Fatalf("relative manifest exit code = %d; stderr=%q", exitCode, stderr)
+	}
+	exitCode, stdout, stderr = runCLIInDir(t, dir, "--compare-manifest", "relative.sha256", "same.bin")
+	if exitCode != 0 || strings.Contains(stdout+stderr, "NEW ") {
+		t.Fatalf("exit code = %d, output = %q; want same.bin to match ./same.bin", exitCode, stdout+stderr)
+	}
+
+	malformed := filepath.Join(dir, "malformed.sha256")
+	if err := os.WriteFile(malformed, []byte("not a manifest\n"), 0o644); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	for _, args := range [][]string{{"--compare-manifest", malformed}, {"--compare-manifest", manifestPath, "--dry-run"}} {
+		if exitCode, _, _ := runCLI(t, append(args, same)...); exitCode != 2 {
+			t.Fatalf("%v exit code = %d, want 2", args, exitCode)
+		}
+	}
+}
+
+func TestUsageCategoriesCoverAllFlags(t *testing.T) {
+	fs, _ := newFlagSet(io.Discard)
+	listed := make(map[string]bool)
+	for _, category := range usageCategories {
+		for _, name := range category.flags {
+			if fs.Lookup(name) == nil {
+				t.Fatalf("usage category %s lists unknown flag %q", category.title, name)
+			}
+			listed[name] = true
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !f.Hidden && !listed[f.Name] {
+			t.Fatalf("flag --%s is not in a usage category", f.Name)
+		}
+	})
+}
+
+func TestWrapText(t *testing.T) {
+	got := wrapText("write each buffer in pieces of this many MB", 16)
+	want := []string{"write each", "buffer in pieces", "of this many MB"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("wrapText() = %q, want %q", got, want)
+	}
+	if got := wrapText("unbreakable-long-word ok", 5); fmt.Sprint(got) != fmt.Sprint([]string{"unbreakable-long-word", "ok"}) {
+		t.Fatalf("wrapText() with long word = %q", got)
+	}
+}
+
+func TestCLIHelpGroupsAndWrapsFlags(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestCLIMainHelper", "--", "--help")
+	configHome := t.TempDir()
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "HOME="+configHome, "XDG_CONFIG_HOME="+configHome, "COLUMNS=70")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run help: %v", err)
+	}
+
+	help := stderr.String()
+	for _, heading := range []string{"\nSelection:\n", "\nI/O:\n", "\nOutput:\n", "\nSafety:\n"} {
+		if !strings.Contains(help, heading) {
+			t.Fatalf("help output missing %q heading: %q", heading, help)
+		}
+	}
+	if strings.Contains(help, "\nOther:\n") {
+		t.Fatalf("help output has uncategorized flags: %q", help)
+	}
+	for _, line := range strings.Split(help, "\n") {
+		if len(line) > 70 {
+			t.Fatalf("help line exceeds COLUMNS=70: %q", line)
+		}
+	}
+}
+
+func TestRunResetsPerRunState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "reset-state.txt")
+	if err := os.WriteFile(path, []byte("reset"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	var sb syscall.Stat_t
+	if err := syscall.Stat(path, &sb); err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	t.Cleanup(func() {
+		reportedPaths = nil
+		filesystemTypes = map[uint64]string{}
+	})
+
+	var stderr bytes.Buffer
+	if exitCode := run([]string{"--relative-to", dir, path}, nil, &stderr); exitCode != 0 {
+		t.Fatalf("first run exit code = %d, want 0; stderr=%q", exitCode, stderr.String())
+	}
+	// The relative name only exists under dir, so without the mapping from
+	// the first run it cannot be opened from the working directory.
+	stderr.Reset()
+	if exitCode := run([]string{"reset-state.txt"}, nil, &stderr); exitCode != 1 {
+		t.Fatalf("second run exit code = %d, want 1; stderr=%q", exitCode, stderr.String())
+	}
+
+	filesystemTypes[uint64(sb.Dev)] = "stale"
+	stderr.Reset()
+	if exitCode := run([]string{"--skip-fstype", "stale", path}, nil, &stderr); exitCode != 0 {
+		t.Fatalf("--skip-fstype run exit code = %d, want 0; stderr=%q", exitCode, stderr.String())
+	}
+}
+
+func TestCLIRelativeTo(t *testing.T) {
+	base := t.TempDir()
+	sub := filepath.Join(base, "deep", "tree")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	path := filepath.Join(sub, "data.txt")
+	content := []byte("relative")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	other := t.TempDir()
+
+	exitCode, _, stderr := runCLIInDir(t, other, "-v", "--relative-to", base, path)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	want := filepath.Join("deep", "tree", "data.txt")
+	if !strings.Contains(stderr, "Rewriting "+want+"...") || strings.Contains(stderr, path) {
+		t.Fatalf("stderr does not use the relative path %q: %q", want, stderr)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("file content changed")
+	}
+
+	// Only the reported form changes: relative paths given to other options
+	// still resolve against the working directory.
+	missing := filepath.Join(base, "missing.txt")
+	exitCode, _, stderr = runCLIInDir(t, other, "--relative-to", base, "--error-log", "errors.log", "--manifest", "out.sha256", path, missing)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	logged, err := os.ReadFile(filepath.Join(other, "errors.log"))
+	if err != nil {
+		t.Fatalf("read error log in the working directory: %v", err)
+	}
+	if !strings.HasPrefix(string(logged), "missing.txt\t") {
+		t.Fatalf("error log = %q, want the relative path", logged)
+	}
+	manifest, err := os.ReadFile(filepath.Join(other, "out.sha256"))
+	if err != nil {
+		t.Fatalf("read manifest in the working directory: %v", err)
+	}
+	if !strings.HasSuffix(string(manifest), "  "+want+"\n") {
+		t.Fatalf("manifest = %q, want the relative path", manifest)
+	}
+
+	exitCode, _, _ = runCLI(t, "--relative-to", base, "--abspath", path)
+	if exitCode != 2 {
+		t.Fatalf("conflicting flags exit code = %d, want 2", exitCode)
+	}
+}
+
+// memBlocks is an in-memory blockIO that transfers at most maxRead or
+// maxWrite bytes per call, to exercise short transfers without a file.
+type memBlocks struct {
+	data         []byte
+	maxRead      int
+	maxWrite     int
+	writes       int
+	writeOffsets []int64
+}
+
+func (m *memBlocks) pread(buf []byte, offset int64) (int, error) {
+	if offset >= int64(len(m.data)) {
+		return 0, nil
+	}
+	n := copy(buf, m.data[offset:])
+	if m.maxRead > 0 {
+		n = min(n, m.maxRead)
+	}
+	return n, nil
+}
+
+func (m *memBlocks) pwrite(buf []byte, offset int64) (int, error) {
+	n := len(buf)
+	if m.maxWrite > 0 {
+		n = min(n, m.maxWrite)
+	}
+	m.writes++
+	m.writeOffsets = append(m.writeOffsets, offset)
+	return copy(m.data[offset:], buf[:n]), nil
+}
+
+func TestRewriteBlocksWithoutFile(t *testing.T) {
+	want := []byte("the quick brown fox jumps over the lazy dog")
+	for _, bounded := range []bool{true, false} {
+		m := &memBlocks{data: append([]byte(nil), want...), maxRead: 5, maxWrite: 3}
+		done, result, ok := rewriteBlocks(m, "memory", int64(len(want)), bounded, processOptions{bufferSizeBytes: 16})
+		if !ok {
+			t.Fatalf("bounded=%v: rewriteBlocks failed: %+v", bounded, result)
+		}
+		if done != int64(len(want)) {
+			t.Fatalf("bounded=%v: rewrote %d bytes, want %d", bounded, done, len(want))
+		}
+		if !bytes.Equal(m.data, want) {
+			t.Fatalf("bounded=%v: data changed to %q", bounded, m.data)
+		}
+		if minWrites := (len(want) + 2) / 3; m.writes < minWrites {
+			t.Fatalf("bounded=%v: %d writes, want at least %d", bounded, m.writes, minWrites)
+		}
+	}
+}
+
+func TestRewriteBlocksReadError(t *testing.T) {
+	failing := errors.New("source gone")
+	rw := readFailer{&memBlocks{data: []byte("data")}, failing}
+	_, result, ok := rewriteBlocks(rw, "memory", 4, true, processOptions{bufferSizeBytes: 16})
+	if ok || !errors.Is(result.err, errRead) || !errors.Is(result.err, failing) {
+		t.Fatalf("expected wrapped read error, got ok=%v result=%+v", ok, result)
+	}
+}
+
+type readFailer struct {
+	blockIO
+	err error
+}
+
+func (r readFailer) pread([]byte, int64) (int, error) {
+	return 0, r.err
+}
+
+func TestSizeHistogramBuckets(t *testing.T) {
+	h := &sizeHistogram{}
+	for _, result := range []pathResult{
+		{outcome: pathOutcomeRewritten},
+		{outcome: pathOutcomeRewritten, bytesRewritten: 1},
+		{outcome: pathOutcomeRewrittenTimesNotRestored, bytesRewritten: 4096},
+		{outcome: pathOutcomeWouldRewrite, size: 8191},
+		{outcome: pathOutcomeFailed, bytesRewritten: 100},
+		{outcome: pathOutcomeSkippedFiltered},
+	} {
+		h.add(result)
+	}
+	want := []string{
+		"Histogram: min_size=0 max_size=0 files=1 bytes=0",
+		"Histogram: min_size=1 max_size=1 files=1 bytes=1",
+		"Histogram: min_size=4096 max_size=8191 files=2 bytes=12287",
+	}
+	if got := h.lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestCLIHistogram(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, size := range []int{0, 100, 120, 5000} {
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		args := []string{"--histogram"}
+		if dryRun {
+			args = append(args, "--dry-run")
+		}
+		exitCode, stdout, stderr := runCLI(t, append(args, paths...)...)
+		if exitCode != 0 {
+			t.Fatalf("dry-run=%v: exit code = %d, want 0; stderr=%q", dryRun, exitCode, stderr)
+		}
+		if stdout != "" {
+			t.Fatalf("dry-run=%v: unexpected stdout %q", dryRun, stdout)
+		}
+		for _, line := range []string{
+			"Histogram: min_size=0 max_size=0 files=1 bytes=0\n",
+			"Histogram: min_size=64 max_size=127 files=2 bytes=220\n",
+			"Histogram: min_size=4096 max_size=8191 files=1 bytes=5000\n",
+		} {
+			if !strings.Contains(stderr, line) {
+				t.Fatalf("dry-run=%v: stderr missing %q: %q", dryRun, line, stderr)
+			}
+		}
+	}
+}
+
+func TestProcessOpenFileLeavesDescriptorOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	content := []byte("already open")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	result := processOpenFile(int(f.Fd()), path, processOptions{bufferSizeBytes: 4}, nil, nil)
+	if result.outcome != pathOutcomeRewritten || result.bytesRewritten != int64(len(content)) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Fatalf("descriptor was closed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Fatalf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+
+	dir, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open dir: %v", err)
+	}
+	defer dir.Close()
+	result = processOpenFile(int(dir.Fd()), dir.Name(), processOptions{bufferSizeBytes: 4}, nil, nil)
+	if !errors.Is(result.err, errNotRegular) {
+		t.Fatalf("directory result = %+v, want errNotRegular", result)
+	}
+}
+
+func TestShufflePathsIsReproducible(t *testing.T) {
+	paths := make([]string, 20)
+	for i := range paths {
+		paths[i] = strconv.Itoa(i)
+	}
+	first := append([]string(nil), paths...)
+	second := append([]string(nil), paths...)
+	shufflePaths(first, 42)
+	shufflePaths(second, 42)
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Fatalf("same seed gave %v and %v", first, second)
+	}
+	if strings.Join(first, ",") == strings.Join(paths, ",") {
+		t.Fatal("shuffle left the order unchanged")
+	}
+	other := append([]string(nil), paths...)
+	shufflePaths(other, 43)
+	if strings.Join(first, ",") == strings.Join(other, ",") {
+		t.Fatal("different seeds gave the same order")
+	}
+}
+
+func TestCLIShuffleWithSeed(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i := range 8 {
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	want := append([]string(nil), paths...)
+	shufflePaths(want, 7)
+
+	exitCode, _, stderr := runCLI(t, append([]string{"-v", "--shuffle", "--seed", "7"}, paths...)...)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Shuffling 8 paths with --seed 7.\n") {
+		t.Fatalf("stderr missing seed line: %q", stderr)
+	}
+	var got []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if path, ok := strings.CutPrefix(line, "Rewriting "); ok {
+			got = append(got, strings.TrimSuffix(path, "..."))
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+
+	exitCode, _, stderr = runCLI(t, append([]string{"--shuffle"}, paths...)...)
+	if exitCode != 0 || !strings.Contains(stderr, "Shuffling 8 paths with --seed ") {
+		t.Fatalf("random seed was not logged: exit=%d stderr=%q", exitCode, stderr)
+	}
+	exitCode, _, stderr = runCLI(t, append([]string{"--seed", "7"}, paths...)...)
+	if exitCode != 0 || strings.Contains(stderr, "Shuffling") {
+		t.Fatalf("--seed without --shuffle: exit=%d stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIOnErrorPolicies(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, []byte("policy"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	exitCode, _, stderr := runCLI(t, "--stats", dir, path)
+	if exitCode != 1 || !strings.Contains(stderr, " skipped_non_regular=1 ") || !strings.Contains(stderr, " failures=1 ") {
+		t.Fatalf("continue: exit=%d stderr=%q", exitCode, stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--stats", "--on-error=skip", dir, path)
+	if exitCode != 0 {
+		t.Fatalf("skip: exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "SKIP NON-REGULAR "+dir+"\n") || strings.Contains(stderr, "is not a regular file") || !strings.Contains(stderr, " skipped_non_regular=1 ") || !strings.Contains(stderr, " failures=0 ") || !strings.Contains(stderr, " rewritten=1 ") {
+		t.Fatalf("skip: unexpected stderr %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--stats", "--on-error=skip", missing, path)
+	if exitCode != 1 || !strings.Contains(stderr, " failures=1 ") {
+		t.Fatalf("skip with a missing path: exit=%d stderr=%q", exitCode, stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--stats", "--on-error=abort", missing, path, dir)
+	if exitCode != 1 {
+		t.Fatalf("abort: exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "2 of 3 paths were not started") || !strings.Contains(stderr, " rewritten=0 ") || !strings.Contains(stderr, " not_started=2 ") {
+		t.Fatalf("abort: unexpected stderr %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--on-error=retry", path)
+	if exitCode != 2 || !strings.Contains(stderr, `invalid --on-error policy "retry"`) {
+		t.Fatalf("invalid policy: exit=%d stderr=%q", exitCode, stderr)
+	}
+}
+
+func TestCLIMaxErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, []byte("limit"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	missing1 := filepath.Join(dir, "missing1")
+	missing2 := filepath.Join(dir, "missing2")
+	missing3 := filepath.Join(dir, "missing3")
+
+	exitCode, _, stderr := runCLI(t, "--stats", "--max-errors", "2", missing1, path, missing2, missing3, path)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "Stopping after 2 failed paths (--max-errors); 1 paths were processed without failing and 2 of 5 were not started.") {
+		t.Fatalf("stderr missing stop warning: %q", stderr)
+	}
+	if !strings.Contains(stderr, " failures=2 ") || !strings.Contains(stderr, " not_started=2 ") {
+		t.Fatalf("unexpected summary: %q", stderr)
+	}
+
+	exitCode, _, stderr = runCLI(t, "--stats", "--max-errors", "3", missing1, path, missing2)
+	if exitCode != 1 || strings.Contains(stderr, "Stopping after") || !strings.Contains(stderr, " not_started=0 ") {
+		t.Fatalf("below the limit: exit=%d stderr=%q", exitCode, stderr)
+	}
+
+	exitCode, _, _ = runCLI(t, "--max-errors", "-1", path)
+	if exitCode != 2 {
+		t.Fatalf("negative limit exit code = %d, want 2", exitCode)
+	}
+}
+
+func TestCLINamesPipesAndSockets(t *testing.T) {
+	dir := t.TempDir()
+	fifoPath := filepath.Join(dir, "pipe")
+	if err := syscall.Mkfifo(fifoPath, 0o644); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	socketPath := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	exitCode, _, stderr := runCLI(t, fifoPath, socketPath)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	for _, want := range []string{fifoPath + " is a named pipe, skipping.", socketPath + " is a socket, skipping."} {
+		if !strings.Contains(stderr, want) {
+			t.Fatalf("stderr missing %q: %q", want, stderr)
+		}
+	}
+}
+
+func TestProcessPathDoesNotBlockOnSwappedFIFO(t *testing.T) {
+	fifoPath := filepath.Join(t.TempDir(), "pipe")
+	if err := syscall.Mkfifo(fifoPath, 0o644); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+
+	// Report the FIFO as a regular file to simulate it being swapped in
+	// between the lstat check and the open.
+	savedLstat := lstatFile
+	lstatFile = func(path string, sb *syscall.Stat_t) error {
+		if err := savedLstat(path, sb); err != nil {
+			return err
+		}
+		sb.Mode = sb.Mode&^syscall.S_IFMT | syscall.S_IFREG
+		return nil
+	}
+	var openFlags int
+	savedOpen := openFile
+	openFile = func(path string, mode int, perm uint32) (int, error) {
+		openFlags = mode
+		return savedOpen(path, mode, perm)
+	}
+	t.Cleanup(func() {
+		lstatFile = savedLstat
+		openFile = savedOpen
+	})
+
+	done := make(chan pathResult, 1)
+	go func() {
+		done <- processPath(fifoPath, processOptions{bufferSizeBytes: 1024}, nil)
+	}()
+	select {
+	case result := <-done:
+		if !errors.Is(result.err, errNotRegular) {
+			t.Fatalf("result = %+v, want errNotRegular", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("processPath blocked opening a FIFO")
+	}
+	if openFlags&syscall.O_NONBLOCK == 0 {
+		t.Fatalf("open flags %#x do not include O_NONBLOCK", openFlags)
+	}
+}
+
+func TestCLIAtimeOlderThan(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.txt")
+	fresh := filepath.Join(dir, "fresh.txt")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("atime"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(stale, now.Add(-48*time.Hour), now); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := os.Chtimes(fresh, now, now); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--stats", "--atime-older-than", "24h", stale, fresh)
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "SKIP FILTERED "+fresh+"\n") || strings.Contains(stderr, "SKIP FILTERED "+stale) {
+		t.Fatalf("unexpected filtering: %q", stderr)
+	}
+	if !strings.Contains(stderr, " rewritten=1 ") || !strings.Contains(stderr, " skipped_filtered=1 ") {
+		t.Fatalf("unexpected summary: %q", stderr)
+	}
+
+	exitCode, _, _ = runCLI(t, "--atime-older-than", "-1h", stale)
+	if exitCode != 2 {
+		t.Fatalf("negative duration exit code = %d, want 2", exitCode)
+	}
+}
+
+func TestCLIMtimeWindow(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ages := map[string]time.Duration{"new.txt": time.Hour, "mid.txt": 10 * 24 * time.Hour, "old.txt": 60 * 24 * time.Hour}
+	paths := make(map[string]string)
+	for name, age := range ages {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("mtime"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+		if err := os.Chtimes(path, now, now.Add(-age)); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+		paths[name] = path
+	}
+
+	exitCode, _, stderr := runCLI(t, "--dry-run", "--older-than", "168h", "--newer-than", "720h", paths["new.txt"], paths["mid.txt"], paths["old.txt"])
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	for name, want := range map[string]string{"new.txt": "WOULD SKIP FILTERED ", "mid.txt": "WOULD REWRITE ", "old.txt": "WOULD SKIP FILTERED "} {
+		if !strings.Contains(stderr, want+paths[name]+"\n") {
+			t.Fatalf("stderr missing %q for %s: %q", want, name, stderr)
+		}
+	}
+
+	exitCode, _, stderr = runCLI(t, "--dry-run", "--older-than", "720h", "--newer-than", "168h", paths["mid.txt"])
+	if exitCode != exitNothingRewritten {
+		t.Fatalf("empty window exit code = %d, want %d; stderr=%q", exitCode, exitNothingRewritten, stderr)
+	}
+	if !strings.Contains(stderr, "selects no files") || !strings.Contains(stderr, "WOULD SKIP FILTERED "+paths["mid.txt"]+"\n") {
+		t.Fatalf("empty window: unexpected stderr %q", stderr)
+	}
+
+	if exitCode, _, _ := runCLI(t, "--older-than", "-1h", paths["mid.txt"]); exitCode != 2 {
+		t.Fatalf("negative --older-than exit code = %d, want 2", exitCode)
+	}
+}
+
+func TestAtimeFilterWarnsOnNoatimeMount(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, path := range paths {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	var stderr bytes.Buffer
+	savedErrorOutput := errorOutput
+	errorOutput = &stderr
+	savedNoAtime := noAtimeMount
+	noAtimeMount = func(fd int) bool { return true }
+	t.Cleanup(func() {
+		errorOutput = savedErrorOutput
+		noAtimeMount = savedNoAtime
+	})
+
+	keep := atimeFilter(time.Now().Add(time.Hour))
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("lstat: %v", err)
+		}
+		if !keep(path, info) {
+			t.Fatalf("%s was filtered out, want it kept", path)
+		}
+	}
+	if got := strings.Count(stderr.String(), "is on a noatime mount"); got != 1 {
+		t.Fatalf("noatime warnings = %d, want 1: %q", got, stderr.String())
+	}
+}
+
+func TestCLIDryRunJSONPlan(t *testing.T) {
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep.bin")
+	if err := os.WriteFile(keep, []byte("12345"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	skip := filepath.Join(dir, "skip.tmp")
+	if err := os.WriteFile(skip, []byte("123"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	link := filepath.Join(dir, "link.bin")
+	if err := os.Link(keep, link); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	excludeFile := filepath.Join(t.TempDir(), "exclude")
+	if err := os.WriteFile(excludeFile, []byte("*.tmp\n"), 0o644); err != nil {
+		t.Fatalf("write exclude file: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	exitCode, stdout, stderr := runCLI(t, "--dry-run", "--json", "--dedup-hardlinks", "--exclude-from", excludeFile, keep, skip, link, dir, missing)
+	if exitCode != 1 {
+		t.Fatalf("exit code = %d, want 1; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "WOULD REWRITE "+keep) {
+		t.Fatalf("stderr missing dry-run report: %q", stderr)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines, want 5 entries and a summary: %q", len(lines), stdout)
+	}
+	var entries []planEntry
+	for _, line := range lines[:5] {
+		var entry planEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	var summary planSummary
+	if err := json.Unmarshal([]byte(lines[5]), &summary); err != nil {
+		t.Fatalf("decode summary %q: %v", lines[5], err)
+	}
+	if summary.Type != "summary" || summary.FilesProcessed != 5 || summary.FilesFailed != 2 || summary.FilesSkipped != 2 || summary.Bytes != 5 || summary.ExitCode != 1 {
+		t.Fatalf("summary = %+v, want 5 files, 2 failed, 2 skipped, 5 bytes, exit code 1", summary)
+	}
+	want := []struct {
+		path, action, reason string
+		size                 int64
+		hasSize              bool
+	}{
+		{keep, planActionRewrite, "", 5, true},
+		{skip, planActionSkip, planReasonFiltered, 3, true},
+		{link, planActionSkip, planReasonHardlink, 5, true},
+		{dir, planActionFail, planReasonNonRegular, 0, false},
+		{missing, planActionFail, "", 0, false},
+	}
+	for i, w := range want {
+		got := entries[i]
+		if got.Path != w.path || got.Action != w.action || got.Reason != w.reason || (got.Size != nil) != w.hasSize || (got.Size != nil && *got.Size != w.size) {
+			t.Fatalf("entry %d = %+v, want %+v", i, got, w)
+		}
+	}
+	if entries[4].Error == "" {
+		t.Fatalf("missing path has no error: %+v", entries[4])
+	}
+
+	exitCode, stdout, stderr = runCLI(t, "--dry-run", "--json", "--on-error=skip", keep, dir)
+	if exitCode != 0 {
+		t.Fatalf("on-error=skip: exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+	if !strings.Contains(stderr, "SKIP NON-REGULAR "+dir+"\n") || strings.Contains(stderr, "is not a regular file") {
+		t.Fatalf("on-error=skip: unexpected stderr %q", stderr)
+	}
+	lines = strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("on-error=skip: got %d lines, want 2 entries and a summary: %q", len(lines), stdout)
+	}
+	var skipped planEntry
+	if err := json.Unmarshal([]byte(lines[1]), &skipped); err != nil {
+		t.Fatalf("decode %q: %v", lines[1], err)
+	}
+	if skipped.Path != dir || skipped.Action != planActionSkip || skipped.Reason != planReasonNonRegular || skipped.Error != "" {
+		t.Fatalf("on-error=skip entry = %+v, want a skip without an error", skipped)
+	}
+
+	for _, args := range [][]string{{"--json", keep}, {"--json", "--dry-run", "--count-only", keep}} {
+		exitCode, _, _ = runCLI(t, args...)
+		if exitCode != 2 {
+			t.Fatalf("%v: exit code = %d, want 2", args, exitCode)
+		}
+	}
+}
+
+func TestCLIShortFlagBundlingAndGoStyleLongFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("flags"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	tests := []struct {
+		args        []string
+		wantExit    int
+		wantStderr  string
+		wantVerbose bool
+	}{
+		{args: []string{"-vb", "4"}, wantVerbose: true},
+		{args: []string{"-vb", "0"}, wantExit: 2, wantStderr: "invalid buffer size 0 MB"},
+		{args: []string{"-bv", "4"}, wantExit: 2, wantStderr: `invalid argument "v" for "-b, --buffersize" flag`},
+		{args: []string{"-b4"}},
+		{args: []string{"-b0"}, wantExit: 2, wantStderr: "invalid buffer size 0 MB"},
+		{args: []string{"-verbose"}, wantVerbose: true},
+		{args: []string{"-buffersize=0"}, wantExit: 2, wantStderr: "invalid buffer size 0 MB"},
+		{args: []string{"-buffersize", "4", "-stats"}, wantStderr: "Summary: paths=1 rewritten=1 "},
+	}
+	for _, tt := range tests {
+		exitCode, _, stderr := runCLI(t, append(tt.args, path)...)
+		if exitCode != tt.wantExit {
+			t.Fatalf("%v: exit code = %d, want %d; stderr=%q", tt.args, exitCode, tt.wantExit, stderr)
+		}
+		if !strings.Contains(stderr, tt.wantStderr) {
+			t.Fatalf("%v: stderr missing %q: %q", tt.args, tt.wantStderr, stderr)
+		}
+		if got := strings.Contains(stderr, "Rewriting "+path+"..."); got != tt.wantVerbose {
+			t.Fatalf("%v: verbose output present = %v, want %v: %q", tt.args, got, tt.wantVerbose, stderr)
+		}
+	}
+}
+
+func TestNormalizeGoStyleLongFlags(t *testing.T) {
+	fs, _ := newFlagSet(io.Discard)
+	got, err := normalizeGoStyleLongFlags(fs, []string{"-verbose", "-vb", "4", "-b4", "-buffersize=4", "--stats", "-", "-x", "file", "--exclude-from", "-stats", "-relative-to", "-abspath", "-b", "-stats", "--", "-stats"})
+	want := []string{"--verbose", "-vb", "4", "-b4", "--buffersize=4", "--stats", "-", "-x", "file", "--exclude-from", "-stats", "--relative-to", "-abspath", "-b", "-stats", "--", "-stats"}
+	if err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("normalized = %q, want %q", got, want)
+	}
+}
+
+func TestCLIFlagValueEdgeCases(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(path, []byte("values"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	other := filepath.Join(dir, "other.bin")
+	if err := os.WriteFile(other, []byte("values"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	// A file whose name looks like a Go-style long flag.
+	if err := os.WriteFile(filepath.Join(dir, "-stats"), []byte("*.txt\n"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	tests := []struct {
+		args       []string
+		wantExit   int
+		wantStderr string
+	}{
+		{args: []string{"-b=4", path}},
+		{args: []string{"-b=0", path}, wantExit: 2, wantStderr: "invalid buffer size 0 MB"},
+		{args: []string{"-buffersize=-1", path}, wantExit: 2, wantStderr: "invalid buffer size -1 MB"},
+		{args: []string{"-b", "-1", path}, wantExit: 2, wantStderr: "invalid buffer size -1 MB"},
+		{args: []string{"--exclude-from", "-stats", path, other}, wantStderr: "SKIP FILTERED " + path},
+		{args: []string{"-exclude-from", "-stats", path, other}, wantStderr: "SKIP FILTERED " + path},
+		{args: []string{"--dry-run", "--", "-stats", path}, wantStderr: "WOULD REWRITE -stats"},
+	}
+	for _, tt := range tests {
+		exitCode, _, stderr := runCLIInDir(t, dir, tt.args...)
+		if exitCode != tt.wantExit {
+			t.Fatalf("%v: exit code = %d, want %d; stderr=%q", tt.args, exitCode, tt.wantExit, stderr)
+		}
+		if !strings.Contains(stderr, tt.wantStderr) {
+			t.Fatalf("%v: stderr missing %q: %q", tt.args, tt.wantStderr, stderr)
+		}
+		if strings.Contains(stderr, "Summary:") {
+			t.Fatalf("%v: a flag value was parsed as --stats: %q", tt.args, stderr)
+		}
+	}
+}
+
+func TestCLIFlagPrefixes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("prefix"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	tests := []struct {
+		args       []string
+		wantExit   int
+		wantStderr string
+	}{
+		{args: []string{"-buf", "4"}},
+		{args: []string{"-buf", "0"}, wantExit: 2, wantStderr: "invalid buffer size 0 MB"},
+		{args: []string{"--buf=0"}, wantExit: 2, wantStderr: "invalid buffer size 0 MB"},
+		{args: []string{"-verb"}, wantStderr: "Rewriting " + path + "..."},
+		{args: []string{"-vv"}, wantStderr: "Read 6 from " + path},
+		{args: []string{"-ver"}, wantExit: 2, wantStderr: "ambiguous flag -ver: could be --verbose, --verify-pass, --verify-relocation, --version"},
+		{args: []string{"--stat"}, wantExit: 2, wantStderr: "ambiguous flag --stat: could be --stats, --stats-interval"},
+		{args: []string{"--stats"}, wantStderr: "Summary: "},
+		{args: []string{"--simulate=1"}, wantExit: 2, wantStderr: "unknown flag: --simulate"},
+	}
+	for _, tt := range tests {
+		exitCode, _, stderr := runCLI(t, append(tt.args, path)...)
+		if exitCode != tt.wantExit {
+			t.Fatalf("%v: exit code = %d, want %d; stderr=%q", tt.args, exitCode, tt.wantExit, stderr)
+		}
+		if !strings.Contains(stderr, tt.wantStderr) {
+			t.Fatalf("%v: stderr missing %q: %q", tt.args, tt.wantStderr, stderr)
+		}
+	}
+}
+
+func TestRewriteBlocksReverse(t *testing.T) {
+	want := []byte("0123456789")
+	m := &memBlocks{data: append([]byte(nil), want...), maxRead: 3}
+	var progress []int64
+	options := processOptions{
+		bufferSizeBytes: 4,
+		reverse:         true,
+		progressFunc: func(_ string, done, total int64) {
+			if total != int64(len(want)) {
+				t.Fatalf("progress total = %d, want %d", total, len(want))
+			}
+			progress = append(progress, done)
+		},
+	}
+	done, result, ok := rewriteBlocks(m, "memory", int64(len(want)), true, options)
+	if !ok {
+		t.Fatalf("rewriteBlocks failed: %+v", result)
+	}
+	if done != int64(len(want)) || !bytes.Equal(m.data, want) {
+		t.Fatalf("rewrote %d bytes, data %q; want %d bytes, %q", done, m.data, len(want), want)
+	}
+	if got := fmt.Sprint(m.writeOffsets); got != "[6 2 0]" {
+		t.Fatalf("write offsets = %s, want [6 2 0]", got)
+	}
+	if got := fmt.Sprint(progress); got != "[4 8 10]" {
+		t.Fatalf("progress = %s, want [4 8 10]", got)
+	}
+}
+
+func TestRewriteBlocksStride(t *testing.T) {
+	want := []byte("0123456789")
+	for _, tc := range []struct {
+		reverse bool
+		offsets string
+	}{
+		{false, "[0 6]"},
+		{true, "[8 2]"},
+	} {
+		m := &memBlocks{data: append([]byte(nil), want...)}
+		options := processOptions{bufferSizeBytes: 2, stride: 3, reverse: tc.reverse}
+		done, result, ok := rewriteBlocks(m, "memory", int64(len(want)), true, options)
+		if !ok {
+			t.Fatalf("reverse=%v: rewriteBlocks failed: %+v", tc.reverse, result)
+		}
+		if done != 4 || !bytes.Equal(m.data, want) {
+			t.Fatalf("reverse=%v: rewrote %d bytes, data %q", tc.reverse, done, m.data)
+		}
+		if got := fmt.Sprint(m.writeOffsets); got != tc.offsets {
+			t.Fatalf("reverse=%v: write offsets = %s, want %s", tc.reverse, got, tc.offsets)
+		}
+	}
+}
+
+func TestCLIReverse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	content := bytes.Repeat([]byte("reverse "), 1000)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--reverse", "--stats", path)
+	if exitCode != 0 || !strings.Contains(stderr, fmt.Sprintf(" bytes_rewritten=%d ", len(content))) {
+		t.Fatalf("exit=%d stderr=%q", exitCode, stderr)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("file content changed")
+	}
+
+	exitCode, _, _ = runCLI(t, "--reverse", "--follow-growth", path)
+	if exitCode != 2 {
+		t.Fatalf("--reverse --follow-growth exit code = %d, want 2", exitCode)
+	}
+}
+
+func TestCLIStride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	content := bytes.Repeat([]byte("s"), 5*bytesPerMB)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "-b", "1", "--stride", "2", "--stats", path)
+	if exitCode != 0 || !strings.Contains(stderr, fmt.Sprintf(" bytes_rewritten=%d ", 3*bytesPerMB)) {
+		t.Fatalf("exit=%d stderr=%q", exitCode, stderr)
+	}
+
+	for _, args := range [][]string{{"--stride", "0"}, {"--stride", "2", "--skip-if-clean"}} {
+		if exitCode, _, _ := runCLI(t, append(args, path)...); exitCode != 2 {
+			t.Fatalf("%v exit code = %d, want 2", args, exitCode)
+		}
+	}
+}
+
+func TestCLISkipIfCleanNeedsContentMarkers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("clean"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	exitCode, _, stderr := runCLI(t, "--skip-if-clean", path)
+	if !contentMarkersSupported {
+		if exitCode != 2 || strings.Count(stderr, "--skip-if-clean stores content hashes in extended attributes") != 1 {
+			t.Fatalf("exit=%d stderr=%q, want one usage error and status 2", exitCode, stderr)
+		}
+		return
+	}
+	if exitCode != 0 {
+		t.Fatalf("exit code = %d, want 0; stderr=%q", exitCode, stderr)
+	}
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// followFinalSupported reports whether --follow-final can be used here. It
+// needs openat(2), which the syscall package only provides on Linux.
+const followFinalSupported = true
+
+// openParentDir opens the directory part of path one component at a time,
+// each relative to the last with O_NOFOLLOW, so a symlink anywhere in it
+// fails instead of being followed. It returns the directory and the final
+// component of path.
+func openParentDir(path string) (int, string, error) {
+	path = filepath.Clean(path)
+	start := "."
+	if filepath.IsAbs(path) {
+		start = "/"
+	}
+	dirfd, err := syscall.Open(start, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	dir, base := filepath.Split(path)
+	walked := strings.TrimSuffix(start, ".")
+	for _, component := range strings.Split(dir, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		walked += component + "/"
+		next, err := syscall.Openat(dirfd, component, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		_ = syscall.Close(dirfd)
+		if err != nil {
+			return -1, "", fmt.Errorf("directory %s is a symlink or cannot be opened: %w", walked, err)
+		}
+		dirfd = next
+	}
+	return dirfd, base, nil
+}
+
+// openFollowingFinal opens path for --follow-final: the directory part may
+// not contain symlinks, but the final component is followed if it is one.
+func openFollowingFinal(path string, flags int, perm uint32) (int, error) {
+	dirfd, base, err := openParentDir(path)
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		_ = syscall.Close(dirfd)
+	}()
+	return syscall.Openat(dirfd, base, flags&^syscall.O_NOFOLLOW, perm)
+}
+
+// statFollowingFinal is stat(2) with the symlink rules of openFollowingFinal.
+// The final component is resolved through /dev/fd, which works like
+// fstatat(2) on the directory.
+func statFollowingFinal(path string, sb *syscall.Stat_t) error {
+	dirfd, base, err := openParentDir(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = syscall.Close(dirfd)
+	}()
+	return syscall.Stat(fmt.Sprintf("/dev/fd/%d/%s", dirfd, base), sb)
+}
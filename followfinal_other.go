@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// followFinalSupported reports whether --follow-final can be used here. The
+// syscall package has no openat(2) on this platform.
+const followFinalSupported = false
+
+func openFollowingFinal(path string, flags int, perm uint32) (int, error) {
+	return -1, syscall.ENOTSUP
+}
+
+func statFollowingFinal(path string, sb *syscall.Stat_t) error {
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,21 @@
+//go:build darwin || freebsd
+
+package main
+
+import "syscall"
+
+// filesystemType returns the f_fstypename of the filesystem fd lives on.
+func filesystemType(fd int) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &fs); err != nil {
+		return "", err
+	}
+	name := make([]byte, 0, len(fs.Fstypename))
+	for _, c := range fs.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name), nil
+}
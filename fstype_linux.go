@@ -0,0 +1,46 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// filesystemMagics maps statfs f_type values to filesystem names.
+var filesystemMagics = map[uint32]string{
+	0x0000EF53: "ext2/ext3/ext4",
+	0x9123683E: "btrfs",
+	0x58465342: "xfs",
+	0x2FC12FC1: "zfs",
+	0xF2F52010: "f2fs",
+	0xCA451A4E: "bcachefs",
+	0x52654973: "reiserfs",
+	0x3153464A: "jfs",
+	0x00003434: "nilfs",
+	0x00006969: "nfs",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x00C36400: "ceph",
+	0x65735546: "fuse",
+	0x01021994: "tmpfs",
+	0x858458F6: "ramfs",
+	0x794C7630: "overlayfs",
+	0x73717368: "squashfs",
+	0x00004D44: "vfat",
+	0x2011BAB0: "exfat",
+	0x5346544E: "ntfs",
+	0x0000482B: "hfsplus",
+}
+
+// filesystemType names the filesystem fd lives on from its statfs magic.
+func filesystemType(fd int) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &fs); err != nil {
+		return "", err
+	}
+	if name, ok := filesystemMagics[uint32(fs.Type)]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("unknown (%#x)", uint32(fs.Type)), nil
+}
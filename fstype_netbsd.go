@@ -0,0 +1,11 @@
+//go:build netbsd
+
+package main
+
+import "syscall"
+
+// filesystemType is unsupported on NetBSD, where the syscall package does
+// not expose statvfs.
+func filesystemType(fd int) (string, error) {
+	return "", syscall.ENOTSUP
+}
@@ -0,0 +1,21 @@
+//go:build openbsd
+
+package main
+
+import "syscall"
+
+// filesystemType returns the f_fstypename of the filesystem fd lives on.
+func filesystemType(fd int) (string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &fs); err != nil {
+		return "", err
+	}
+	name := make([]byte, 0, len(fs.F_fstypename))
+	for _, c := range fs.F_fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	return string(name), nil
+}
@@ -0,0 +1,52 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// sizeHistogram buckets files by size for --histogram. Bucket 0 holds empty
+// files and bucket k holds sizes from 2^(k-1) to 2^k-1 bytes.
+type sizeHistogram struct {
+	files [65]int
+	bytes [65]int64
+}
+
+// add records result if it was rewritten, or would have been with --dry-run.
+// Other outcomes are ignored.
+func (h *sizeHistogram) add(result pathResult) {
+	if h == nil {
+		return
+	}
+	var size int64
+	switch result.outcome {
+	case pathOutcomeRewritten, pathOutcomeRewrittenTimesNotRestored:
+		size = result.bytesRewritten
+	case pathOutcomeWouldRewrite:
+		size = result.size
+	default:
+		return
+	}
+	bucket := bits.Len64(uint64(size))
+	h.files[bucket]++
+	h.bytes[bucket] += size
+}
+
+// lines returns one line per non-empty bucket, smallest sizes first.
+func (h *sizeHistogram) lines() []string {
+	var lines []string
+	for bucket, files := range h.files {
+		if files == 0 {
+			continue
+		}
+		var low, high uint64
+		if bucket > 0 {
+			low = 1 << (bucket - 1)
+			high = low<<1 - 1
+		}
+		lines = append(lines, fmt.Sprintf("Histogram: min_size=%d max_size=%d files=%d bytes=%d", low, high, files, h.bytes[bucket]))
+	}
+	return lines
+}
@@ -0,0 +1,13 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// seekHole is the lseek(2) whence value for SEEK_HOLE, which differs from
+// Linux and FreeBSD.
+const seekHole = 3
+
+func firstHole(fd int) (int64, error) {
+	return syscall.Seek(fd, 0, seekHole)
+}
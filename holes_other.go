@@ -0,0 +1,9 @@
+//go:build netbsd || openbsd
+
+package main
+
+import "syscall"
+
+func firstHole(fd int) (int64, error) {
+	return 0, syscall.ENOTSUP
+}
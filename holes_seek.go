@@ -0,0 +1,15 @@
+//go:build linux || freebsd
+
+package main
+
+import "syscall"
+
+// seekHole is the lseek(2) whence value for SEEK_HOLE.
+const seekHole = 4
+
+// firstHole returns the offset of the first hole in fd using lseek(2) with
+// SEEK_HOLE. A file without holes reports its size, where the implicit hole
+// at end of file starts.
+func firstHole(fd int) (int64, error) {
+	return syscall.Seek(fd, 0, seekHole)
+}
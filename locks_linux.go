@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procLocksPath lists the file locks held on the system, one per line:
+//
+//	1: POSIX  ADVISORY  WRITE 1234 08:01:131 0 EOF
+//
+// Requests waiting for a lock have "->" after the id and are not held.
+var procLocksPath = "/proc/locks"
+
+// devMajor and devMinor split a device number the way glibc's major(3) and
+// minor(3) do, truncating each to 32 bits.
+func devMajor(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff) | uint32(dev>>32)&^0xfff
+}
+
+func devMinor(dev uint64) uint32 {
+	return uint32(dev&0xff) | uint32(dev>>12)&^0xff
+}
+
+// fileLockHolder looks up a lock held on the file with the given device and
+// inode by another process. It returns a description of the first one found,
+// such as "POSIX ADVISORY WRITE lock held by pid 1234".
+func fileLockHolder(dev, ino uint64) (string, bool, error) {
+	data, err := os.ReadFile(procLocksPath)
+	if err != nil {
+		return "", false, err
+	}
+	want := fmt.Sprintf("%02x:%02x:%d", devMajor(dev), devMinor(dev), ino)
+	self := strconv.Itoa(os.Getpid())
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] == "->" || fields[5] != want || fields[4] == self {
+			continue
+		}
+		holder := "an unknown process"
+		if fields[4] != "-1" {
+			holder = "pid " + fields[4]
+		}
+		return fmt.Sprintf("%s %s %s lock held by %s", fields[1], fields[2], fields[3], holder), true, nil
+	}
+	return "", false, scanner.Err()
+}
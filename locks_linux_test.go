@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFileLockHolderParsesProcLocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks")
+	self := strconv.Itoa(os.Getpid())
+	content := "1: POSIX  ADVISORY  WRITE " + self + " fe:01:131 0 EOF\n" +
+		"1: -> FLOCK  ADVISORY  WRITE 4321 fe:01:131 0 EOF\n" +
+		"2: OFDLCK ADVISORY  READ  -1 08:01:131 0 EOF\n" +
+		"3: FLOCK  ADVISORY  WRITE 1234 fe:01:131 0 EOF\n" +
+		"4: POSIX  ADVISORY  WRITE 5678 1103:12345:131 0 EOF\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write locks: %v", err)
+	}
+	original := procLocksPath
+	procLocksPath = path
+	t.Cleanup(func() { procLocksPath = original })
+
+	holder, locked, err := fileLockHolder(0xfe01, 131)
+	if err != nil || !locked || holder != "FLOCK ADVISORY WRITE lock held by pid 1234" {
+		t.Fatalf("fileLockHolder = %q, %v, %v; want the FLOCK held by pid 1234", holder, locked, err)
+	}
+	holder, locked, err = fileLockHolder(0x801, 131)
+	if err != nil || !locked || holder != "OFDLCK ADVISORY READ lock held by an unknown process" {
+		t.Fatalf("fileLockHolder = %q, %v, %v; want the OFD lock", holder, locked, err)
+	}
+	// Major 0x1103 and minor 0x12345, whose high major bits must not leak
+	// into the minor.
+	holder, locked, err = fileLockHolder(0x100012310345, 131)
+	if err != nil || !locked || holder != "POSIX ADVISORY WRITE lock held by pid 5678" {
+		t.Fatalf("fileLockHolder = %q, %v, %v; want the POSIX lock on 1103:12345", holder, locked, err)
+	}
+	if _, locked, err := fileLockHolder(0xfe01, 132); err != nil || locked {
+		t.Fatalf("fileLockHolder on an unlocked inode = %v, %v; want no lock", locked, err)
+	}
+}
@@ -0,0 +1,134 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// manifestState is the result of checking a file against --compare-manifest.
+type manifestState int
+
+const (
+	manifestUnchecked manifestState = iota
+	manifestMatch
+	manifestMismatch
+	manifestNew
+)
+
+// manifestWriter writes one sha256sum(1) line per rewritten file for
+// --manifest. Like the error log, each line is written as soon as the file
+// is done, so a manifest survives an interrupted run.
+type manifestWriter struct {
+	path string
+	f    *os.File
+}
+
+func createManifest(path string) (*manifestWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create manifest %s: %w", path, err)
+	}
+	return &manifestWriter{path: path, f: f}, nil
+}
+
+// manifestLine formats a line as sha256sum does: "<hash>  <path>". Like
+// sha256sum, a path containing a backslash or newline has them escaped and
+// the line prefixed with a backslash, so sha256sum -c reads it back.
+func manifestLine(hash, path string) string {
+	if !strings.ContainsAny(path, "\\\n") {
+		return hash + "  " + path + "\n"
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(path)
+	return "\\" + hash + "  " + escaped + "\n"
+}
+
+func (m *manifestWriter) add(result pathResult) {
+	if m == nil || result.sha256 == "" {
+		return
+	}
+	if _, err := m.f.WriteString(manifestLine(result.sha256, result.path)); err != nil {
+		logWarningWithError(err, "Unable to write to manifest %s", m.path)
+	}
+}
+
+func (m *manifestWriter) close() {
+	if m == nil {
+		return
+	}
+	if err := m.f.Close(); err != nil {
+		logWarningWithError(err, "Unable to close manifest %s", m.path)
+	}
+}
+
+// readManifest reads a manifest written by --manifest or sha256sum(1) for
+// --compare-manifest and returns the hash recorded for each path, keyed by
+// its filepath.Clean form so that "./a" and "a" match. Lines in
+// sha256sum's binary mode ("<hash> *<path>") are accepted too.
+func readManifest(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open manifest %s: %w", path, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok || len(name) < 2 || (name[0] != ' ' && name[0] != '*') {
+			return nil, fmt.Errorf("manifest %s line %d: not a sha256sum line", path, lineNo)
+		}
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+			return nil, fmt.Errorf("manifest %s line %d: invalid SHA-256 hash %q", path, lineNo, hash)
+		}
+		name = name[1:]
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+		hashes[filepath.Clean(name)] = strings.ToLower(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read manifest %s: %w", path, err)
+	}
+	return hashes, nil
+}
+
+// compareManifest checks the content of fd against the hash recorded for
+// path by --compare-manifest. This reads the file once before it is
+// rewritten, so a mismatch is reported while the old data is still in place.
+// A failed read is returned as a failed result, like any read error.
+func compareManifest(fd int, path string, options processOptions, sb *syscall.Stat_t) (manifestState, pathResult, bool) {
+	want, known := options.knownHashes[filepath.Clean(path)]
+	if !known {
+		logInfo("NEW %s: not in the manifest", path)
+		return manifestNew, pathResult{}, true
+	}
+	hash, result, ok := hashOpenFile(fd, path, options, sb)
+	if !ok {
+		return manifestUnchecked, result, false
+	}
+	if hash != want {
+		logWarning("MISMATCH %s: manifest has %s, file now hashes to %s", path, want, hash)
+		return manifestMismatch, pathResult{}, true
+	}
+	logVerbose(verbosityFiles, "%s matches the manifest.", path)
+	return manifestMatch, pathResult{}, true
+}
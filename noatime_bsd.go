@@ -0,0 +1,23 @@
+//go:build darwin || freebsd
+
+package main
+
+import "syscall"
+
+const (
+	utimeOmit  = -2
+	mntNoAtime = 0x10000000
+
+	// openNoAtime is zero because O_NOATIME is Linux-only.
+	openNoAtime = 0
+)
+
+// atimeDisabled reports whether fd lives on a mount that does not track
+// access times, based on the statfs f_flags mount options.
+func atimeDisabled(fd int) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &fs); err != nil {
+		return false
+	}
+	return uint64(fs.Flags)&mntNoAtime != 0
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+const (
+	utimeOmit = (1 << 30) - 2
+	stNoAtime = 0x400
+
+	// openNoAtime is ORed into the open flags by --noatime-open.
+	openNoAtime = syscall.O_NOATIME
+)
+
+// atimeDisabled reports whether fd lives on a mount that does not track
+// access times, based on the statfs f_flags mount options.
+func atimeDisabled(fd int) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &fs); err != nil {
+		return false
+	}
+	return fs.Flags&stNoAtime != 0
+}
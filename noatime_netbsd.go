@@ -0,0 +1,16 @@
+//go:build netbsd
+
+package main
+
+const (
+	utimeOmit = (1 << 30) - 2
+
+	// openNoAtime is zero because O_NOATIME is Linux-only.
+	openNoAtime = 0
+)
+
+// atimeDisabled always reports false on NetBSD, where the syscall package
+// does not expose statvfs mount flags.
+func atimeDisabled(fd int) bool {
+	return false
+}
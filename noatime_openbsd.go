@@ -0,0 +1,23 @@
+//go:build openbsd
+
+package main
+
+import "syscall"
+
+const (
+	utimeOmit  = -1
+	mntNoAtime = 0x8000
+
+	// openNoAtime is zero because O_NOATIME is Linux-only.
+	openNoAtime = 0
+)
+
+// atimeDisabled reports whether fd lives on a mount that does not track
+// access times, based on the statfs f_flags mount options.
+func atimeDisabled(fd int) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &fs); err != nil {
+		return false
+	}
+	return fs.F_flags&mntNoAtime != 0
+}
@@ -0,0 +1,156 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Actions and reasons written by --dry-run --json.
+const (
+	planActionRewrite = "rewrite"
+	planActionTouch   = "touch"
+	planActionSkip    = "skip"
+	planActionFail    = "fail"
+
+	planReasonFiltered   = "filtered"
+	planReasonHardlink   = "hardlink"
+	planReasonSparse     = "sparse"
+	planReasonLocked     = "locked"
+	planReasonNonRegular = "non-regular"
+)
+
+// planEntry is one JSON line of a --dry-run --json plan. Size is omitted for
+// paths that failed or were rejected before their size was known.
+type planEntry struct {
+	Path   string `json:"path"`
+	Size   *int64 `json:"size,omitempty"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// planSummary is the last line of a --dry-run --json plan. Its Type field,
+// always "summary", tells it apart from the planEntry lines, which have none.
+type planSummary struct {
+	Type           string  `json:"type"`
+	FilesProcessed int     `json:"files_processed"`
+	FilesFailed    int     `json:"files_failed"`
+	FilesSkipped   int     `json:"files_skipped"`
+	Bytes          int64   `json:"bytes"`
+	DurationMS     int64   `json:"duration_ms"`
+	ThroughputMBps float64 `json:"throughput_mbps"`
+	ExitCode       int     `json:"exit_code"`
+}
+
+// planWriter writes a planEntry for every dry-run result as newline-delimited
+// JSON, followed by a planSummary. A nil planWriter writes nothing.
+type planWriter struct {
+	enc       *json.Encoder
+	touchOnly bool
+	// bytes is the total size of the files planned for rewriting.
+	bytes int64
+}
+
+func newPlanWriter(w io.Writer, touchOnly bool) *planWriter {
+	return &planWriter{enc: json.NewEncoder(w), touchOnly: touchOnly}
+}
+
+func (p *planWriter) add(result pathResult) {
+	if p == nil {
+		return
+	}
+	size := result.size
+	entry := planEntry{Path: result.path, Size: &size, Action: planActionSkip}
+	switch result.outcome {
+	case pathOutcomeWouldRewrite:
+		entry.Action = planActionRewrite
+		if p.touchOnly {
+			entry.Action = planActionTouch
+		} else {
+			p.bytes += size
+		}
+	case pathOutcomeSkippedFiltered:
+		entry.Reason = planReasonFiltered
+	case pathOutcomeSkippedHardlink:
+		entry.Reason = planReasonHardlink
+	case pathOutcomeSkippedSparse:
+		entry.Reason = planReasonSparse
+	case pathOutcomeSkippedLocked:
+		entry.Reason = planReasonLocked
+	case pathOutcomeSkippedNonRegular:
+		entry.Size = nil
+		entry.Reason = planReasonNonRegular
+	case pathOutcomeRejectedNonRegular:
+		entry.Size = nil
+		entry.Action = planActionFail
+		entry.Reason = planReasonNonRegular
+	default:
+		entry.Size = nil
+		entry.Action = planActionFail
+	}
+	if result.err != nil {
+		entry.Error = result.err.Error()
+	}
+	_ = p.enc.Encode(entry)
+}
+
+// finish writes the summary line with the run's totals. bytes counts the
+// files planned for rewriting, and throughput is how fast the plan was made,
+// in MB/s.
+func (p *planWriter) finish(stats runStats, elapsed time.Duration, exitCode int) {
+	if p == nil {
+		return
+	}
+	throughput := 0.0
+	if elapsed > 0 {
+		throughput = math.Round(float64(p.bytes)/bytesPerMB/elapsed.Seconds()*100) / 100
+	}
+	_ = p.enc.Encode(planSummary{
+		Type:           "summary",
+		FilesProcessed: stats.paths,
+		FilesFailed:    stats.failures,
+		FilesSkipped:   stats.paths - stats.failures - stats.rewritten - stats.wouldRewrite - stats.touched,
+		Bytes:          p.bytes,
+		DurationMS:     elapsed.Milliseconds(),
+		ThroughputMBps: throughput,
+		ExitCode:       exitCode,
+	})
+}
+
+// workPlanEntry is one file in a --plan work plan made by an external
+// planner.
+type workPlanEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// readWorkPlan reads a --plan file, a JSON array of workPlanEntry, and
+// returns its paths in order and the sum of their sizes. The paths are not
+// checked here: like command-line arguments, each one is validated when it is
+// opened.
+func readWorkPlan(path string) ([]string, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read plan %s: %w", path, err)
+	}
+	var entries []workPlanEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, 0, fmt.Errorf("parse plan %s: %w", path, err)
+	}
+	paths := make([]string, 0, len(entries))
+	var total int64
+	for i, entry := range entries {
+		if entry.Path == "" || entry.Size < 0 {
+			return nil, 0, fmt.Errorf("plan %s entry %d: want a path and a size of at least 0", path, i+1)
+		}
+		paths = append(paths, entry.Path)
+		total += entry.Size
+	}
+	return paths, total, nil
+}
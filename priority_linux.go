@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority applies nice and the idle I/O class to every thread of the
+// process. Linux tracks both per thread, and threads the Go runtime starts
+// later inherit the values from the thread that creates them.
+func lowerPriority(nice int, idleIO bool) error {
+	tids, err := processThreadIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, tid := range tids {
+		if nice != 0 {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+				return fmt.Errorf("set nice %d: %w", nice, err)
+			}
+		}
+		if idleIO {
+			prio := ioprioClassIdle << ioprioClassShift
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+				return fmt.Errorf("set idle I/O priority: %w", errno)
+			}
+		}
+	}
+
+	if nice != 0 {
+		logVerbose(verbosityFiles, "Set CPU nice value to %d.", nice)
+	}
+	if idleIO {
+		logVerbose(verbosityFiles, "Set I/O priority class to idle.")
+	}
+	return nil
+}
+
+func processThreadIDs() ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, fmt.Errorf("list process threads: %w", err)
+	}
+
+	tids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+	return tids, nil
+}
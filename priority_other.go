@@ -0,0 +1,13 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+func lowerPriority(nice int, idleIO bool) error {
+	if nice != 0 {
+		logVerbose(verbosityFiles, "--nice is only supported on Linux; ignoring.")
+	}
+	if idleIO {
+		logVerbose(verbosityFiles, "--ionice is only supported on Linux; ignoring.")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// progressBarWidth is the number of cells in the --progress-bar bar.
+const progressBarWidth = 30
+
+var (
+	// progressBarRedraw is how often the bar is redrawn on a terminal.
+	progressBarRedraw = 200 * time.Millisecond
+	// progressBarLineInterval is how often a bar line is printed when the
+	// output is not a terminal and cannot be redrawn in place.
+	progressBarLineInterval = 10 * time.Second
+)
+
+// selectionSize returns the combined size of the regular files in paths, as
+// the total for --progress-bar. It only stats each path, without logging, so
+// paths that are later skipped or fail still count and the total is an upper
+// bound.
+func selectionSize(paths []string, followSymlinks bool) int64 {
+	var total int64
+	for _, path := range paths {
+		var sb syscall.Stat_t
+		stat := lstatFile
+		if followSymlinks {
+			stat = statFile
+		}
+		if err := stat(path, &sb); err == nil && sb.Mode&syscall.S_IFMT == syscall.S_IFREG {
+			total += sb.Size
+		}
+	}
+	return total
+}
+
+// fileStart records path as the file currently being processed.
+func (p *batchProgress) fileStart(path string) {
+	if p == nil {
+		return
+	}
+	p.current.Store(&path)
+}
+
+// barLine renders the aggregate progress bar after elapsed, for example
+// "[#########---------------------]  30.0% 300.0/1000.0 MB 3/10 files ETA 7s data.bin".
+func (p *batchProgress) barLine(elapsed time.Duration) string {
+	done := p.bytes.Load()
+	fraction := 1.0
+	if p.totalBytes > 0 {
+		fraction = min(float64(done)/float64(p.totalBytes), 1)
+	}
+	filled := int(fraction * progressBarWidth)
+	eta := "?"
+	if done >= p.totalBytes {
+		eta = "0s"
+	} else if done > 0 {
+		eta = time.Duration(float64(elapsed) * float64(p.totalBytes-done) / float64(done)).Round(time.Second).String()
+	}
+	current := ""
+	if path := p.current.Load(); path != nil {
+		current = " " + *path
+	}
+	return fmt.Sprintf("[%s%s] %5.1f%% %.1f/%.1f MB %d/%d files ETA %s%s",
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled),
+		fraction*100, float64(done)/bytesPerMB, float64(p.totalBytes)/bytesPerMB,
+		p.files.Load(), p.totalFiles, eta, current)
+}
+
+// startBar draws the --progress-bar to w until the returned stop function is
+// called, which draws it a final time. On a terminal the bar is redrawn in
+// place with a carriage return, and cleared by writeLine before any other
+// line is written; otherwise a line is printed periodically.
+func (p *batchProgress) startBar(w io.Writer, terminal bool) func() {
+	start := time.Now()
+	// Drawing takes outputMu like the log functions, so the bar and log
+	// lines never interleave.
+	draw := func() {
+		line := p.barLine(time.Since(start))
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		if terminal {
+			_, _ = fmt.Fprintf(w, "\r%s\x1b[K", line)
+			drawnBar = w
+		} else {
+			_, _ = fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+	interval := progressBarLineInterval
+	if terminal {
+		interval = progressBarRedraw
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				draw()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		draw()
+		if terminal {
+			outputMu.Lock()
+			defer outputMu.Unlock()
+			_, _ = fmt.Fprintln(w)
+			drawnBar = nil
+		}
+	}
+}
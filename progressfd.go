@@ -0,0 +1,112 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// Event names written to --progress-fd.
+const (
+	progressEventFileStart    = "file-start"
+	progressEventFileProgress = "file-progress"
+	progressEventFileDone     = "file-done"
+	progressEventBatchDone    = "batch-done"
+)
+
+// progressEvent is one JSON line on the --progress-fd stream. Byte counters
+// are always present so consumers do not need to special-case zero.
+type progressEvent struct {
+	Event      string `json:"event"`
+	Path       string `json:"path,omitempty"`
+	BytesDone  int64  `json:"bytes_done"`
+	BytesTotal int64  `json:"bytes_total,omitempty"`
+	Failed     bool   `json:"failed,omitempty"`
+	Files      int    `json:"files,omitempty"`
+	Failures   int    `json:"failures,omitempty"`
+	// Dev and Ino are set on file-done events of failed files, and the
+	// offsets when the failure happened at a known position.
+	Dev            *uint64 `json:"dev,omitempty"`
+	Ino            *uint64 `json:"ino,omitempty"`
+	Offset         *int64  `json:"offset,omitempty"`
+	PhysicalOffset *int64  `json:"physical_offset,omitempty"`
+}
+
+// progressStream writes progressEvents as newline-delimited JSON. Write
+// errors are ignored so a front-end closing its end of the pipe cannot fail
+// the rewrite itself.
+type progressStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newProgressStream(w io.Writer) *progressStream {
+	return &progressStream{enc: json.NewEncoder(w)}
+}
+
+// progressFD writes to a file descriptor inherited for --progress-fd. It does
+// not own the descriptor, which is left open when the run finishes.
+type progressFD int
+
+// openProgressFD checks that fd is an open descriptor.
+func openProgressFD(fd int) (progressFD, error) {
+	var sb syscall.Stat_t
+	if err := syscall.Fstat(fd, &sb); err != nil {
+		return 0, fmt.Errorf("invalid progress fd %d: %w", fd, err)
+	}
+	return progressFD(fd), nil
+}
+
+func (fd progressFD) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := syscall.Write(int(fd), p[written:])
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (s *progressStream) emit(event progressEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(event)
+}
+
+func (s *progressStream) fileStart(path string) {
+	s.emit(progressEvent{Event: progressEventFileStart, Path: path})
+}
+
+func (s *progressStream) fileProgress(path string, done, total int64) {
+	s.emit(progressEvent{Event: progressEventFileProgress, Path: path, BytesDone: done, BytesTotal: total})
+}
+
+func (s *progressStream) fileDone(result pathResult) {
+	event := progressEvent{Event: progressEventFileDone, Path: result.path, BytesDone: result.bytesRewritten, Failed: result.failed()}
+	if l := result.location; l != nil {
+		event.Dev, event.Ino = &l.dev, &l.ino
+		if l.offset >= 0 {
+			event.Offset = &l.offset
+		}
+		if l.physical >= 0 {
+			event.PhysicalOffset = &l.physical
+		}
+	}
+	s.emit(event)
+}
+
+func (s *progressStream) batchDone(stats runStats) {
+	s.emit(progressEvent{Event: progressEventBatchDone, BytesDone: stats.bytesRewritten, Files: stats.paths, Failures: stats.failures})
+}
@@ -7,6 +7,13 @@ import (
 	"syscall"
 )
 
+// statTimeFields and restoreTimesMethod describe the timestamp mechanism
+// used on this platform, for -vvv logging.
+const (
+	statTimeFields     = "Stat_t.Atim and Stat_t.Mtim"
+	restoreTimesMethod = "UtimesNano on /dev/fd"
+)
+
 func statTimes(sb *syscall.Stat_t) (syscall.Timespec, syscall.Timespec, bool) {
 	return sb.Atim, sb.Mtim, true
 }
@@ -7,6 +7,13 @@ import (
 	"syscall"
 )
 
+// statTimeFields and restoreTimesMethod describe the timestamp mechanism
+// used on this platform, for -vvv logging.
+const (
+	statTimeFields     = "Stat_t.Atimespec and Stat_t.Mtimespec"
+	restoreTimesMethod = "UtimesNano on /dev/fd"
+)
+
 func statTimes(sb *syscall.Stat_t) (syscall.Timespec, syscall.Timespec, bool) {
 	return sb.Atimespec, sb.Mtimespec, true
 }
@@ -0,0 +1,146 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	flag "github.com/spf13/pflag"
+)
+
+const defaultUsageWidth = 80
+
+// usageCategories groups flags in --help output, in display order. Visible
+// flags missing from this list are shown under "Other".
+var usageCategories = []struct {
+	title string
+	flags []string
+}{
+	{"Selection", []string{"glob", "glob-nomatch-ok", "exclude-from", "plan", "retry-failed", "atime-older-than", "older-than", "newer-than", "skip-fstype", "only-fstype", "shuffle", "seed", "check-first", "keep-going", "on-error", "max-errors", "follow-symlinks", "follow-final", "dedup-hardlinks", "skip-sparse", "warn-on-holes", "respect-locks", "skip-readonly", "skip-if-clean", "allow-devices", "count-only", "deadline", "until"}},
+	{"I/O", []string{"buffersize", "chunk-size", "autotune", "reverse", "stride", "follow-growth", "noatime-open", "nice", "ionice"}},
+	{"Timestamps", []string{"touch-only", "time", "set-atime", "set-mtime", "strict-times"}},
+	{"Output", []string{"verbose", "dry-run", "json", "stats", "histogram", "stats-interval", "progress-bar", "progress-fd", "color", "abspath", "relative-to", "error-log", "manifest", "compare-manifest"}},
+	{"Safety", []string{"paranoid", "verify-pass", "verify-relocation"}},
+	{"General", []string{"config", "selfupdate", "version", "help"}},
+}
+
+// terminalWidth returns the width of the terminal w is attached to, falling
+// back to $COLUMNS and then defaultUsageWidth.
+func terminalWidth(w io.Writer) int {
+	if f, ok := w.(*os.File); ok {
+		var ws struct{ row, col, xpixel, ypixel uint16 }
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+		if errno == 0 && ws.col > 0 {
+			return int(ws.col)
+		}
+	}
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return defaultUsageWidth
+}
+
+// wrapText splits text into lines of at most width characters, breaking only
+// at spaces. Words longer than width are kept whole.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line == "" {
+			line = word
+		} else {
+			line += " " + word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func usageLabel(f *flag.Flag) string {
+	typeName := ""
+	if f.Value.Type() != "bool" && f.Value.Type() != "count" {
+		typeName = " " + f.Value.Type()
+	}
+	if f.Shorthand != "" {
+		return fmt.Sprintf("-%s, --%s%s", f.Shorthand, f.Name, typeName)
+	}
+	return fmt.Sprintf("--%s%s", f.Name, typeName)
+}
+
+func usageDescription(f *flag.Flag) string {
+	if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+		return fmt.Sprintf("%s (default %s)", f.Usage, f.DefValue)
+	}
+	return f.Usage
+}
+
+// printUsage writes the grouped flag list. The label column is as wide as
+// the longest label, and descriptions wrap to the terminal width.
+func printUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	_, _ = fmt.Fprintf(out, "Usage of %s:\n", appName)
+	_, _ = fmt.Fprintf(out, "  %s [flags] file ...\n", appName)
+
+	type group struct {
+		title string
+		flags []*flag.Flag
+	}
+	var groups []group
+	listed := make(map[string]bool)
+	for _, category := range usageCategories {
+		g := group{title: category.title}
+		for _, name := range category.flags {
+			listed[name] = true
+			if f := fs.Lookup(name); f != nil && !f.Hidden {
+				g.flags = append(g.flags, f)
+			}
+		}
+		groups = append(groups, g)
+	}
+	other := group{title: "Other"}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !listed[f.Name] && !f.Hidden {
+			other.flags = append(other.flags, f)
+		}
+	})
+	groups = append(groups, other)
+
+	labelWidth := 0
+	for _, g := range groups {
+		for _, f := range g.flags {
+			labelWidth = max(labelWidth, len(usageLabel(f)))
+		}
+	}
+	indent := 2 + labelWidth + 2
+	// Very narrow terminals get long lines rather than one word per line.
+	descWidth := max(terminalWidth(out)-indent, 30)
+
+	for _, g := range groups {
+		if len(g.flags) == 0 {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "\n%s:\n", g.title)
+		for _, f := range g.flags {
+			lines := wrapText(usageDescription(f), descWidth)
+			if len(lines) == 0 {
+				lines = []string{""}
+			}
+			_, _ = fmt.Fprintf(out, "  %-*s  %s\n", labelWidth, usageLabel(f), lines[0])
+			for _, line := range lines[1:] {
+				_, _ = fmt.Fprintf(out, "%s%s\n", strings.Repeat(" ", indent), line)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// contentMarkersSupported reports whether --skip-if-clean can store and read
+// content markers on this platform.
+const contentMarkersSupported = true
+
+// contentMarker returns the content hash stored on fd by setContentMarker,
+// or "" if none has been stored.
+func contentMarker(fd int) (string, error) {
+	buf := make([]byte, 128)
+	n, err := syscall.Getxattr(fmt.Sprintf("/dev/fd/%d", fd), contentMarkerAttr, buf)
+	if errors.Is(err, syscall.ENODATA) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
+
+func setContentMarker(fd int, value string) error {
+	return syscall.Setxattr(fmt.Sprintf("/dev/fd/%d", fd), contentMarkerAttr, []byte(value), 0)
+}
@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// contentMarkersSupported is false because content markers are stored in
+// Linux extended attributes, so --skip-if-clean is rejected here.
+const contentMarkersSupported = false
+
+func contentMarker(fd int) (string, error) {
+	return "", syscall.ENOTSUP
+}
+
+func setContentMarker(fd int, value string) error {
+	return syscall.ENOTSUP
+}